@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lxzan/gws"
+)
+
+// outcomes of a pushed CALL as reported to the "ack_callback_url"
+const (
+	outcomeAcknowledged = "acknowledged"
+	outcomeRejected     = "rejected"
+	outcomeTimeout      = "timeout"
+)
+
+// pendingAck is a pushed CALL that is waiting for its CALLRESULT or CALLERROR
+type pendingAck struct {
+	mutex     sync.Mutex
+	address   string
+	messageId string
+	message   []byte
+	attempts  int
+	timer     *time.Timer
+	done      bool
+}
+
+// ackOutcome is the JSON body that is posted to the "ack_callback_url"
+type ackOutcome struct {
+	ClientId  string `json:"clientId"`
+	MessageId string `json:"messageId"`
+	Outcome   string `json:"outcome"`
+	Attempts  int    `json:"attempts"`
+	ErrorCode string `json:"errorCode,omitempty"`
+}
+
+// push writes a pushed message to the client after its queued messages
+func (c *Handler) push(client *Client, opcode gws.Opcode, payload []byte) error {
+	client.flushMutex.Lock()
+	defer client.flushMutex.Unlock()
+	c.writeQueue(client)
+	return c.writePush(client, opcode, payload)
+}
+
+// writePush writes a pushed message to the client and tracks it until it is
+// acknowledged when it is a CALL and "ack_timeout" is set
+func (c *Handler) writePush(client *Client, opcode gws.Opcode, payload []byte) error {
+	err := client.writeMessage(opcode, payload)
+	if err != nil || c.config.AckTimeout <= 0 || opcode != gws.OpcodeText {
+		return err
+	}
+	messageType, messageId, ok := parseMessageId(string(payload))
+	if ok && messageType == ocppCall {
+		c.trackAck(client.address, messageId, payload)
+	}
+	return nil
+}
+
+// trackAck starts the ack timer of a pushed CALL, a CALL that is tracked
+// with the same message id is replaced
+func (c *Handler) trackAck(address, messageId string, message []byte) {
+	pending := &pendingAck{address: address, messageId: messageId, message: message, attempts: 1}
+	key := replyKey(address, messageId)
+	shard := c.acks.GetSharding(key)
+	shard.Lock()
+	if previous, ok := shard.Load(key); ok {
+		previous.stop()
+	} else {
+		atomic.AddInt64(&c.tracking, 1)
+	}
+	shard.Store(key, pending)
+	pending.mutex.Lock()
+	pending.timer = time.AfterFunc(c.config.AckTimeout, func() { c.ackTimeout(pending) })
+	pending.mutex.Unlock()
+	shard.Unlock()
+}
+
+// stop cancels the timer, it returns false when it was already stopped
+func (p *pendingAck) stop() bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.done {
+		return false
+	}
+	p.done = true
+	p.timer.Stop()
+	return true
+}
+
+// untrackAck removes a tracked CALL, it returns false when it is not (or no longer) tracked
+func (c *Handler) untrackAck(pending *pendingAck) bool {
+	key := replyKey(pending.address, pending.messageId)
+	shard := c.acks.GetSharding(key)
+	shard.Lock()
+	defer shard.Unlock()
+	if current, ok := shard.Load(key); !ok || current != pending {
+		return false
+	}
+	shard.Delete(key)
+	atomic.AddInt64(&c.tracking, -1)
+	return pending.stop()
+}
+
+// ackTimeout retransmits a CALL that was not acknowledged in time, or
+// reports it when it was sent "ack_retries" times
+func (c *Handler) ackTimeout(pending *pendingAck) {
+	pending.mutex.Lock()
+	if pending.done {
+		pending.mutex.Unlock()
+		return
+	}
+	if pending.attempts <= c.config.AckRetries {
+		if client, ok := c.connections.Load(pending.address); ok {
+			pending.attempts++
+			err := client.writeMessage(gws.OpcodeText, pending.message)
+			if err != nil {
+				log.Printf("ackTimeout: could not retransmit message: %s", err.Error())
+			}
+			pending.timer.Reset(c.config.AckTimeout)
+			pending.mutex.Unlock()
+			return
+		}
+	}
+	pending.mutex.Unlock()
+	if c.untrackAck(pending) {
+		log.Printf("ackTimeout: no reply for message: %s", pending.messageId)
+		c.reportAck(pending, outcomeTimeout, "")
+	}
+}
+
+// acknowledgeReply stops tracking the CALL that a CALLRESULT or CALLERROR of
+// the client replies to and reports the outcome
+func (c *Handler) acknowledgeReply(address, message string) {
+	if atomic.LoadInt64(&c.tracking) == 0 {
+		return
+	}
+	messageType, messageId, ok := parseMessageId(message)
+	if !ok || (messageType != ocppCallResult && messageType != ocppCallError) {
+		return
+	}
+	pending, ok := c.acks.Load(replyKey(address, messageId))
+	if !ok || !c.untrackAck(pending) {
+		return
+	}
+	if messageType == ocppCallResult {
+		c.reportAck(pending, outcomeAcknowledged, "")
+		return
+	}
+	errorCode := ""
+	var fields []json.RawMessage
+	if json.Unmarshal([]byte(message), &fields) == nil && len(fields) > 2 {
+		json.Unmarshal(fields[2], &errorCode)
+	}
+	c.reportAck(pending, outcomeRejected, errorCode)
+}
+
+// reportAck posts the outcome of a tracked CALL to the "ack_callback_url"
+func (c *Handler) reportAck(pending *pendingAck, outcome, errorCode string) {
+	if c.config.AckCallbackUrl == "" {
+		return
+	}
+	pending.mutex.Lock()
+	attempts := pending.attempts
+	pending.mutex.Unlock()
+	body, _ := json.Marshal(ackOutcome{pending.address, pending.messageId, outcome, attempts, errorCode})
+	header := http.Header{}
+	header.Set("Content-Type", "application/json")
+	go func() {
+		_, _, err := c.fetchData(c.client, nil, "POST", c.config.AckCallbackUrl, string(body), header)
+		if err != nil {
+			log.Printf("reportAck: %s", err.Error())
+		}
+	}()
+}
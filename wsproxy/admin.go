@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"strings"
+)
+
+// publicHandler serves only the websocket upgrades, it is used on the public
+// listener when the API is served on the admin listener
+type publicHandler struct {
+	handler *Handler
+}
+
+func (p publicHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	if request.Header.Get("Upgrade") != "websocket" {
+		writer.WriteHeader(404)
+		writer.Write([]byte("not found"))
+		log.Printf("publicHandler: no upgrade requested: %s %s", request.Method, request.URL.Path)
+		return
+	}
+	p.handler.serveConnect(writer, request)
+}
+
+// adminHandler serves the push API, statistics, metrics, profiling (on
+// "/debug/pprof/") and connection management on the admin listener
+type adminHandler struct {
+	handler *Handler
+	pprof   *http.ServeMux
+}
+
+// newAdminHandler creates the handler of the admin listener
+func newAdminHandler(handler *Handler) adminHandler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return adminHandler{handler, mux}
+}
+
+func (a adminHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	if strings.HasPrefix(request.URL.Path, "/debug/pprof/") {
+		if !a.handler.authorize(writer, request, scopeProfile) {
+			return
+		}
+		a.pprof.ServeHTTP(writer, request)
+		return
+	}
+	if request.Header.Get("Upgrade") == "websocket" || !a.handler.serveApi(writer, request) {
+		writer.WriteHeader(404)
+		writer.Write([]byte("not found"))
+		log.Printf("adminHandler: not found: %s %s", request.Method, request.URL.Path)
+	}
+}
+
+// listenAdmin listens on the "admin_listen" address, a tcp address (e.g.
+// "127.0.0.1:7002") or a unix socket (e.g. "unix:/run/wsproxy.sock")
+func listenAdmin(address string) (net.Listener, error) {
+	if path, ok := strings.CutPrefix(address, "unix:"); ok {
+		// remove the socket of a previous run
+		if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+			os.Remove(path)
+		}
+		return net.Listen("unix", path)
+	}
+	return net.Listen("tcp", address)
+}
+
+// serveAdmin serves the admin handler on the listener, with TLS when
+// "admin_tls_cert" is set and with client certificates when "admin_client_ca" is set
+func serveAdmin(handler *Handler, listener net.Listener) error {
+	server := &http.Server{Handler: newAdminHandler(handler)}
+	config := handler.config
+	if config.AdminTlsCert == "" {
+		return server.Serve(listener)
+	}
+	server.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	if config.AdminClientCa != "" {
+		pem, err := os.ReadFile(config.AdminClientCa)
+		if err != nil {
+			return fmt.Errorf("serveAdmin: %s", err.Error())
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("serveAdmin: no certificates in %s", config.AdminClientCa)
+		}
+		server.TLSConfig.ClientCAs = pool
+		server.TLSConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return server.ServeTLS(listener, config.AdminTlsCert, config.AdminTlsKey)
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// scopes of the credentials of the API
+const (
+	scopePush       = "push"       // push, broadcast, batch and group messages
+	scopeDisconnect = "disconnect" // close connections
+	scopeReadStats  = "read-stats" // statistics, metrics, connections, groups and routes
+	scopeManage     = "manage"     // change group memberships and route weights
+	scopeProfile    = "profile"    // pprof profiles on the admin listener
+)
+
+// Credential is a token, an HMAC secret or a client certificate that may use
+// the API endpoints of its scopes
+type Credential struct {
+	Name       string     `yaml:"name" toml:"name"`
+	Token      string     `yaml:"token" toml:"token"`             // "Authorization: Bearer <Token>"
+	HmacSecret string     `yaml:"hmac_secret" toml:"hmac_secret"` // "X-Signature: <Name>=<Signature>" with "X-Timestamp" and "X-Nonce"
+	ClientCert string     `yaml:"client_cert" toml:"client_cert"` // common name of the client certificate
+	Scopes     stringList `yaml:"scopes" toml:"scopes"`
+}
+
+// validate checks that the credential can be used
+func (c Credential) validate() error {
+	if c.Name == "" || strings.ContainsAny(c.Name, "=, ") {
+		return fmt.Errorf("validate: credentials must have a name without \"=\", \",\" or spaces")
+	}
+	kinds := 0
+	for _, value := range []string{c.Token, c.HmacSecret, c.ClientCert} {
+		if value != "" {
+			kinds++
+		}
+	}
+	if kinds != 1 {
+		return fmt.Errorf("validate: credential %s: must have either a token, an hmac_secret or a client_cert", c.Name)
+	}
+	for _, scope := range c.Scopes {
+		switch scope {
+		case scopePush, scopeDisconnect, scopeReadStats, scopeManage, scopeProfile:
+		default:
+			return fmt.Errorf("validate: credential %s: unknown scope %q", c.Name, scope)
+		}
+	}
+	return nil
+}
+
+// hasScope tells whether the credential may use the endpoints of the scope
+func (c *Credential) hasScope(scope string) bool {
+	for _, s := range c.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// requestSignature returns the hex encoded HMAC-SHA256 of the method, the
+// path (with query), the timestamp and the SHA-256 of the body
+func requestSignature(secret []byte, method, path, timestamp string, body []byte) string {
+	bodyHash := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(method + "\n" + path + "\n" + timestamp + "\n" + hex.EncodeToString(bodyHash[:])))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// apiSignature returns the signature of an API request, it is the request
+// signature with the nonce after the timestamp
+func apiSignature(secret []byte, method, path, timestamp, nonce string, body []byte) string {
+	return requestSignature(secret, method, path, timestamp+"\n"+nonce, body)
+}
+
+// authenticator checks the credentials of the API requests, a nonce can
+// only be used once within the allowed clock skew
+type authenticator struct {
+	credentials []*Credential
+	maxSkew     time.Duration
+	maxBodySize int64
+	mutex       sync.Mutex
+	seen        map[string]time.Time // nonces and when they may be forgotten
+	swept       time.Time
+}
+
+// newAuthenticator creates an authenticator, it is nil when there are no credentials
+func newAuthenticator(config Config) *authenticator {
+	if len(config.Credentials) == 0 {
+		return nil
+	}
+	a := &authenticator{maxSkew: config.AuthMaxSkew, maxBodySize: int64(config.AuthMaxBodySize), seen: map[string]time.Time{}}
+	for i := range config.Credentials {
+		a.credentials = append(a.credentials, &config.Credentials[i])
+	}
+	return a
+}
+
+// authenticate returns the credential of the request, or the reason why
+// there is none ("missing", "invalid", "expired" or "replayed")
+func (a *authenticator) authenticate(request *http.Request) (*Credential, string) {
+	if request.TLS != nil && len(request.TLS.PeerCertificates) > 0 {
+		commonName := request.TLS.PeerCertificates[0].Subject.CommonName
+		for _, credential := range a.credentials {
+			if credential.ClientCert != "" && credential.ClientCert == commonName {
+				return credential, ""
+			}
+		}
+	}
+	if token, ok := strings.CutPrefix(request.Header.Get("Authorization"), "Bearer "); ok {
+		for _, credential := range a.credentials {
+			if credential.Token != "" && subtle.ConstantTimeCompare([]byte(credential.Token), []byte(token)) == 1 {
+				return credential, ""
+			}
+		}
+		return nil, "invalid"
+	}
+	if signature := request.Header.Get("X-Signature"); signature != "" {
+		return a.verifySignature(request, signature)
+	}
+	return nil, "missing"
+}
+
+// verifySignature checks the "X-Signature: <Name>=<Signature>", the
+// "X-Timestamp" (unix time in seconds) and the "X-Nonce" headers of a request
+func (a *authenticator) verifySignature(request *http.Request, signature string) (*Credential, string) {
+	name, signature, ok := strings.Cut(signature, "=")
+	if !ok {
+		return nil, "invalid"
+	}
+	var credential *Credential
+	for _, c := range a.credentials {
+		if c.HmacSecret != "" && c.Name == name {
+			credential = c
+		}
+	}
+	if credential == nil {
+		return nil, "invalid"
+	}
+	timestamp := request.Header.Get("X-Timestamp")
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return nil, "invalid"
+	}
+	nonce := request.Header.Get("X-Nonce")
+	if nonce == "" || len(nonce) > 128 {
+		return nil, "invalid"
+	}
+	now := time.Now()
+	if skew := now.Sub(time.Unix(seconds, 0)); skew > a.maxSkew || skew < -a.maxSkew {
+		return nil, "expired"
+	}
+	// the body is read before the signature is checked, so it is limited
+	body, err := io.ReadAll(http.MaxBytesReader(nil, request.Body, a.maxBodySize))
+	if err != nil {
+		return nil, "invalid"
+	}
+	request.Body = io.NopCloser(bytes.NewReader(body))
+	expected := apiSignature([]byte(credential.HmacSecret), request.Method, request.URL.RequestURI(), timestamp, nonce, body)
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return nil, "invalid"
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if now.Sub(a.swept) > time.Second {
+		a.swept = now
+		for key, expires := range a.seen {
+			if now.After(expires) {
+				delete(a.seen, key)
+			}
+		}
+	}
+	key := name + "=" + nonce
+	if _, ok := a.seen[key]; ok {
+		return nil, "replayed"
+	}
+	a.seen[key] = time.Unix(seconds, 0).Add(a.maxSkew)
+	return credential, ""
+}
+
+// authorize checks that the request has a credential with the scope, it
+// responds with a 401 or 403 and counts the failure when it does not
+func (c *Handler) authorize(writer http.ResponseWriter, request *http.Request, scope string) bool {
+	if c.auth == nil {
+		return true
+	}
+	credential, reason := c.auth.authenticate(request)
+	if credential == nil {
+		c.metrics.authFailure(reason)
+		writer.Header().Set("WWW-Authenticate", "Bearer")
+		writer.WriteHeader(401)
+		writer.Write([]byte("unauthorized"))
+		log.Printf("authorize: %s credential: %s %s", reason, request.Method, request.URL.Path)
+		return false
+	}
+	if !credential.hasScope(scope) {
+		c.metrics.authFailure("forbidden")
+		writer.WriteHeader(403)
+		writer.Write([]byte("forbidden"))
+		log.Printf("authorize: credential %s has no scope %s", credential.Name, scope)
+		return false
+	}
+	return true
+}
+
+// signingKey is a key that the requests to the API server are signed with
+type signingKey struct {
+	id     string
+	secret []byte
+}
+
+// parseSigningKeys parses the "<Id>:<Secret>" values of "signing_keys"
+func parseSigningKeys(values []string) []signingKey {
+	keys := []signingKey{}
+	for _, value := range values {
+		id, secret, _ := strings.Cut(value, ":")
+		keys = append(keys, signingKey{id, []byte(secret)})
+	}
+	return keys
+}
+
+// signRequest adds the "X-Timestamp" and "X-Signature: <Id>=<Signature>,..."
+// headers with a signature for every signing key, so that the API server can
+// verify that the request comes from the proxy
+func (c *Handler) signRequest(req *http.Request, body string) {
+	if len(c.signingKeys) == 0 {
+		return
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	signatures := make([]string, 0, len(c.signingKeys))
+	for _, key := range c.signingKeys {
+		signatures = append(signatures, key.id+"="+requestSignature(key.secret, req.Method, req.URL.RequestURI(), timestamp, []byte(body)))
+	}
+	req.Header.Set("X-Timestamp", timestamp)
+	req.Header.Set("X-Signature", strings.Join(signatures, ","))
+}
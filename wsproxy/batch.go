@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+
+	"github.com/lxzan/gws"
+)
+
+// batchItem is a message for one client in a batch push, binary messages are base64 encoded
+type batchItem struct {
+	ClientId string `json:"clientId"`
+	Message  string `json:"message"`
+	Binary   bool   `json:"binary"`
+}
+
+// batchResult is the delivery result of the batch item with the given (zero based) index
+type batchResult struct {
+	Index    int    `json:"index"`
+	ClientId string `json:"clientId,omitempty"`
+	Result   string `json:"result,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// batchDecoder reads the items of a JSON array or of NDJSON (one item per line)
+type batchDecoder struct {
+	decoder *json.Decoder
+	array   bool
+}
+
+// newBatchDecoder detects whether the body is a JSON array or NDJSON
+func newBatchDecoder(reader *bufio.Reader) (*batchDecoder, error) {
+	d := &batchDecoder{}
+	for {
+		b, err := reader.Peek(1)
+		if err != nil || (b[0] != ' ' && b[0] != '\t' && b[0] != '\r' && b[0] != '\n') {
+			d.array = err == nil && b[0] == '['
+			break
+		}
+		reader.ReadByte()
+	}
+	d.decoder = json.NewDecoder(reader)
+	if d.array {
+		if _, err := d.decoder.Token(); err != nil {
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+// more reports whether there is another item
+func (d *batchDecoder) more() bool {
+	return d.decoder.More()
+}
+
+// next decodes the next item
+func (d *batchDecoder) next() (batchItem, error) {
+	item := batchItem{}
+	err := d.decoder.Decode(&item)
+	return item, err
+}
+
+// batch pushes a different message to every client (POST /batch) using at most
+// "broadcast_concurrency" concurrent writes and streams back the result of
+// every item as NDJSON in order of completion
+func (c *Handler) batch(writer http.ResponseWriter, request *http.Request) {
+	defer request.Body.Close()
+	decoder, err := newBatchDecoder(bufio.NewReader(request.Body))
+	if err != nil {
+		writer.WriteHeader(400)
+		writer.Write([]byte("bad request"))
+		log.Printf("MethodPost: invalid batch: %s", err.Error())
+		return
+	}
+	writer.Header().Set("Content-Type", "application/x-ndjson")
+	flusher, _ := writer.(http.Flusher)
+	encoder := json.NewEncoder(writer)
+	var mutex sync.Mutex
+	writeResult := func(result batchResult) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		encoder.Encode(result)
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, c.config.BroadcastConcurrency)
+	for index := 0; decoder.more(); index++ {
+		item, err := decoder.next()
+		if err != nil {
+			writeResult(batchResult{Index: index, Error: err.Error()})
+			log.Printf("MethodPost: invalid batch item: %s", err.Error())
+			break
+		}
+		opcode, payload := gws.OpcodeText, []byte(item.Message)
+		if item.Binary {
+			opcode = gws.OpcodeBinary
+			payload, err = base64.StdEncoding.DecodeString(item.Message)
+		}
+		if item.ClientId == "" || err != nil {
+			writeResult(batchResult{Index: index, ClientId: item.ClientId, Error: "invalid item"})
+			continue
+		}
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(index int, item batchItem) {
+			defer wg.Done()
+			result := c.deliver(item.ClientId, opcode, payload)
+			<-slots
+			writeResult(batchResult{Index: index, ClientId: item.ClientId, Result: result})
+		}(index, item)
+	}
+	wg.Wait()
+}
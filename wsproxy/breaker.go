@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"math/rand"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// states of the circuit breaker (as exported in the statistics)
+const (
+	breakerClosed   = 0
+	breakerOpen     = 1
+	breakerHalfOpen = 2
+)
+
+// errCircuitOpen is returned by fetchData when the circuit breaker is open
+var errCircuitOpen = errors.New("fetchData: circuit open")
+
+// fetchError is a failed request to the API server, the status is 0 when
+// no response was received
+type fetchError struct {
+	status  int
+	message string
+}
+
+func (e *fetchError) Error() string {
+	return "fetchData: " + e.message
+}
+
+// retryable tells whether a failed request may succeed when it is repeated
+func retryable(err error) bool {
+	var fetchErr *fetchError
+	return errors.As(err, &fetchErr) && (fetchErr.status == 0 || fetchErr.status >= 500)
+}
+
+// circuitBreaker fails requests to the API server fast after "breaker_threshold"
+// consecutive failures, after "breaker_cooldown" one request is let through
+// to probe whether the API server is back
+type circuitBreaker struct {
+	mutex     sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	state     int
+	failures  int
+	openedAt  time.Time
+}
+
+// allow tells whether a request may be sent to the API server
+func (b *circuitBreaker) allow() bool {
+	if b.threshold <= 0 {
+		return true
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.state = breakerHalfOpen
+		return true
+	case breakerHalfOpen:
+		return false
+	}
+	return true
+}
+
+// record updates the state with the result of a request that was allowed
+func (b *circuitBreaker) record(err error) {
+	if b.threshold <= 0 {
+		return
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if !retryable(err) {
+		b.state = breakerClosed
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= b.threshold {
+		b.state = breakerOpen
+		b.openedAt = time.Now()
+	}
+}
+
+// getState returns the state of the circuit breaker
+func (b *circuitBreaker) getState() int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.state
+}
+
+// backoff returns the exponential backoff with jitter before the given retry (starting at 1)
+func (c *Handler) backoff(retry int) time.Duration {
+	delay := c.config.RetryBackoff << (retry - 1)
+	if delay <= 0 || delay > c.config.RetryMaxBackoff {
+		delay = c.config.RetryMaxBackoff
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// fetchDataRetry does an idempotent request for the client to the API server
+// and repeats it (at most "retries" times) when it failed in a way that may be
+// temporary, the API server is picked again for every attempt
+func (c *Handler) fetchDataRetry(client *Client, connect bool, method, body string, header http.Header) (string, http.Header, error) {
+	clientUrl, upstream := c.clientUrl(client, connect)
+	responseBytes, responseHeader, err := c.fetchData(c.client, upstream, method, clientUrl, body, header)
+	for retry := 1; retry <= c.config.Retries && retryable(err); retry++ {
+		time.Sleep(c.backoff(retry))
+		atomic.AddUint64(&c.statistics.requestsRetried, 1)
+		clientUrl, upstream = c.clientUrl(client, connect)
+		responseBytes, responseHeader, err = c.fetchData(c.client, upstream, method, clientUrl, body, header)
+	}
+	return responseBytes, responseHeader, err
+}
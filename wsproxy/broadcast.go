@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/lxzan/gws"
+)
+
+// delivery results of a message that is pushed to a client
+const (
+	resultDelivered    = "delivered"
+	resultNotConnected = "not connected"
+	resultWriteFailed  = "write failed"
+)
+
+// pushResults holds the delivery results of a message that is pushed to many clients
+type pushResults struct {
+	Delivered    int               `json:"delivered"`
+	NotConnected int               `json:"notConnected"`
+	Queued       int               `json:"queued,omitempty"`
+	Failed       int               `json:"failed"`
+	Results      map[string]string `json:"results"`
+}
+
+// deliver writes a message to the client (or queues it when the client is
+// not connected) and returns the delivery result
+func (c *Handler) deliver(address string, opcode gws.Opcode, payload []byte) string {
+	client, ok := c.connections.Load(address)
+	if !ok {
+		result := c.enqueue(address, opcode, payload)
+		c.metrics.pushResult(result)
+		return result
+	}
+	err := c.push(client, opcode, payload)
+	if err != nil {
+		log.Printf("deliver: could not write message: %s", err.Error())
+		c.metrics.pushResult(resultWriteFailed)
+		return resultWriteFailed
+	}
+	c.metrics.pushResult(resultDelivered)
+	return resultDelivered
+}
+
+// pushToMany writes a message to the clients using at most
+// "broadcast_concurrency" concurrent writes
+func (c *Handler) pushToMany(addresses []string, opcode gws.Opcode, payload []byte) pushResults {
+	results := pushResults{Results: make(map[string]string, len(addresses))}
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	targets := make(chan string)
+	for i := 0; i < c.config.BroadcastConcurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for address := range targets {
+				result := c.deliver(address, opcode, payload)
+				mutex.Lock()
+				results.Results[address] = result
+				mutex.Unlock()
+			}
+		}()
+	}
+	for _, address := range addresses {
+		targets <- address
+	}
+	close(targets)
+	wg.Wait()
+	for _, result := range results.Results {
+		switch result {
+		case resultDelivered:
+			results.Delivered++
+		case resultNotConnected:
+			results.NotConnected++
+		case resultQueued:
+			results.Queued++
+		default:
+			results.Failed++
+		}
+	}
+	return results
+}
+
+// selectTargets returns the ClientIds selected by exactly one of the
+// "clientId" (repeatable), "prefix", "match" (wildcard) or "all" parameters
+func (c *Handler) selectTargets(request *http.Request) ([]string, error) {
+	query := request.URL.Query()
+	selectors := 0
+	for _, name := range []string{"clientId", "prefix", "match", "all"} {
+		if query.Has(name) {
+			selectors++
+		}
+	}
+	if selectors != 1 {
+		return nil, fmt.Errorf("selectTargets: use one of clientId, prefix, match or all")
+	}
+	if query.Has("clientId") {
+		return query["clientId"], nil
+	}
+	pattern := query.Get("match")
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, fmt.Errorf("selectTargets: invalid match: %s", err.Error())
+	}
+	addresses := []string{}
+	c.connections.Range(func(address string, client *Client) bool {
+		switch {
+		case query.Has("prefix"):
+			if strings.HasPrefix(address, query.Get("prefix")) {
+				addresses = append(addresses, address)
+			}
+		case query.Has("match"):
+			if ok, _ := path.Match(pattern, address); ok {
+				addresses = append(addresses, address)
+			}
+		default:
+			addresses = append(addresses, address)
+		}
+		return true
+	})
+	return addresses, nil
+}
+
+// broadcast pushes the request body to the selected clients (POST /broadcast)
+func (c *Handler) broadcast(writer http.ResponseWriter, request *http.Request) {
+	addresses, err := c.selectTargets(request)
+	if err != nil {
+		writer.WriteHeader(400)
+		writer.Write([]byte("bad request"))
+		log.Printf("MethodPost: %s", err.Error())
+		return
+	}
+	defer request.Body.Close()
+	bodyBytes, err := io.ReadAll(request.Body)
+	if err != nil {
+		writer.WriteHeader(500)
+		writer.Write([]byte("internal server error"))
+		log.Println("MethodPost: could not read body")
+		return
+	}
+	results := c.pushToMany(addresses, c.messageOpcode(request.Header.Get("Content-Type")), bodyBytes)
+	writer.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(writer).Encode(results)
+}
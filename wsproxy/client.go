@@ -0,0 +1,150 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lxzan/gws"
+)
+
+// Client holds the state of a websocket connection
+type Client struct {
+	address          string
+	connection       *gws.Conn
+	remoteAddr       string
+	connectedAt      time.Time
+	messagesReceived atomic.Uint64
+	messagesSent     atomic.Uint64
+	lastActivity     atomic.Int64  // unix time in nanoseconds
+	header           http.Header   // forwarded handshake headers
+	query            string        // forwarded handshake query parameters (including "?")
+	session          http.Header   // session token and attributes from the connect decision
+	pending          chan struct{} // messages queued for the API server in ordered mode
+	closed           atomic.Pointer[closeInfo]
+	groups           map[string]struct{} // names of the joined groups (nil when the connection ended)
+	groupsMutex      sync.Mutex
+	variant          *routeVariant     // the API servers of the client
+	vars             map[string]string // path variables of the route
+	kept             *Client           // older connection of the same client (duplicate policy keep)
+	flushMutex       sync.Mutex        // keeps the pushes behind the queued messages
+	metrics          *Metrics
+}
+
+// closeInfo tells who closed a connection when it was not the client
+type closeInfo struct {
+	initiator string
+	reason    string
+}
+
+// connect attaches the websocket connection to the client
+func (c *Client) connect(connection *gws.Conn) {
+	c.connection = connection
+	c.connectedAt = time.Now()
+	c.lastActivity.Store(c.connectedAt.UnixNano())
+}
+
+// received counts a message that was received from the client
+func (c *Client) received() {
+	c.messagesReceived.Add(1)
+	c.lastActivity.Store(time.Now().UnixNano())
+}
+
+// writeMessage sends a message to the client and counts it
+func (c *Client) writeMessage(opcode gws.Opcode, payload []byte) error {
+	c.messagesSent.Add(1)
+	c.metrics.message(directionOut, opcode)
+	c.lastActivity.Store(time.Now().UnixNano())
+	return c.connection.WriteMessage(opcode, payload)
+}
+
+// closedBy records that the connection is closed by the proxy ("proxy") or by the API server ("server")
+func (c *Client) closedBy(initiator, reason string) {
+	c.closed.Store(&closeInfo{initiator, reason})
+}
+
+// newClient creates a client with the handshake metadata that is forwarded to the API server
+func (c *Handler) newClient(address string, request *http.Request) *Client {
+	client := &Client{
+		address:    address,
+		remoteAddr: request.RemoteAddr,
+		header:     http.Header{},
+		query:      "",
+		session:    http.Header{},
+		pending:    nil,
+		groups:     map[string]struct{}{},
+		metrics:    c.metrics,
+	}
+	if c.config.Ordered {
+		client.pending = make(chan struct{}, c.config.ParallelGolimit)
+	}
+	for _, name := range c.config.ForwardHeaders {
+		if values := request.Header.Values(name); len(values) > 0 {
+			client.header[http.CanonicalHeaderKey(name)] = values
+		}
+	}
+	remoteIp, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		remoteIp = request.RemoteAddr
+	}
+	forwardedFor := remoteIp
+	if prior := request.Header.Get("X-Forwarded-For"); prior != "" {
+		forwardedFor = prior + ", " + remoteIp
+	}
+	client.header.Set("X-Forwarded-For", forwardedFor)
+	client.header.Set("X-Real-IP", remoteIp)
+	query := url.Values{}
+	for _, name := range c.config.ForwardQuery {
+		if values, ok := request.URL.Query()[name]; ok {
+			query[name] = values
+		}
+	}
+	if len(query) > 0 {
+		client.query = "?" + query.Encode()
+	}
+	return client
+}
+
+// checkClientUrls tells whether the path variables of the client expand to
+// valid urls for all API servers of its route variant
+func (c *Handler) checkClientUrls(client *Client) error {
+	for _, upstream := range client.variant.pool.upstreams {
+		if _, err := expandUrl(upstream.url, client.vars); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// clientUrl returns the url of the client on the API server of its route, the handshake
+// query parameters are only included on the connect or when forwarded on messages
+// (the urls are checked with checkClientUrls on the connect)
+func (c *Handler) clientUrl(client *Client, connect bool) (string, *upstream) {
+	upstream := client.variant.pool.pick(client.address)
+	serverUrl, _ := expandUrl(upstream.url, client.vars)
+	if connect || c.config.ForwardOnMessage {
+		return serverUrl + url.PathEscape(client.address) + client.query, upstream
+	}
+	return serverUrl + url.PathEscape(client.address), upstream
+}
+
+// connectionHeader returns the headers that are sent to the API server on
+// every request of the connection after the connect
+func (c *Handler) connectionHeader(client *Client) http.Header {
+	header := http.Header{}
+	if c.config.ForwardOnMessage {
+		for key, values := range client.header {
+			header[key] = values
+		}
+	}
+	for key, values := range client.session {
+		header[key] = values
+	}
+	if subprotocol := client.connection.SubProtocol(); subprotocol != "" {
+		header.Set("Sec-WebSocket-Protocol", subprotocol)
+	}
+	return header
+}
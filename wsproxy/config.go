@@ -0,0 +1,458 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds all settings of the proxy, it can be loaded from a YAML or
+// TOML file, environment variables and command-line flags (in that order
+// of increasing precedence).
+type Config struct {
+	Listen               string        `yaml:"listen" toml:"listen"`
+	AdminListen          string        `yaml:"admin_listen" toml:"admin_listen"`
+	AdminTlsCert         string        `yaml:"admin_tls_cert" toml:"admin_tls_cert"`
+	AdminTlsKey          string        `yaml:"admin_tls_key" toml:"admin_tls_key"`
+	AdminClientCa        string        `yaml:"admin_client_ca" toml:"admin_client_ca"`
+	Credentials          []Credential  `yaml:"credentials" toml:"credentials"`
+	AuthMaxSkew          time.Duration `yaml:"auth_max_skew" toml:"auth_max_skew"`
+	AuthMaxBodySize      int           `yaml:"auth_max_body_size" toml:"auth_max_body_size"`
+	ServerUrl            string        `yaml:"server_url" toml:"server_url"`
+	ServerUrls           stringList    `yaml:"server_urls" toml:"server_urls"`
+	Balance              string        `yaml:"balance" toml:"balance"`
+	HealthCheckInterval  time.Duration `yaml:"health_check_interval" toml:"health_check_interval"`
+	HealthCheckPath      string        `yaml:"health_check_path" toml:"health_check_path"`
+	EjectThreshold       int           `yaml:"eject_threshold" toml:"eject_threshold"`
+	EjectDuration        time.Duration `yaml:"eject_duration" toml:"eject_duration"`
+	Routes               []Route       `yaml:"routes" toml:"routes"`
+	MaxProcs             int           `yaml:"max_procs" toml:"max_procs"`
+	MaxConnsPerHost      int           `yaml:"max_conns_per_host" toml:"max_conns_per_host"`
+	MaxIdleConnsPerHost  int           `yaml:"max_idle_conns_per_host" toml:"max_idle_conns_per_host"`
+	ClientTimeout        time.Duration `yaml:"client_timeout" toml:"client_timeout"`
+	CheckUtf8Enabled     bool          `yaml:"check_utf8_enabled" toml:"check_utf8_enabled"`
+	PermessageDeflate    bool          `yaml:"permessage_deflate" toml:"permessage_deflate"`
+	ParallelEnabled      bool          `yaml:"parallel_enabled" toml:"parallel_enabled"`
+	ParallelGolimit      int           `yaml:"parallel_golimit" toml:"parallel_golimit"`
+	Ordered              bool          `yaml:"ordered" toml:"ordered"`
+	ReadMaxPayloadSize   int           `yaml:"read_max_payload_size" toml:"read_max_payload_size"`
+	WriteMaxPayloadSize  int           `yaml:"write_max_payload_size" toml:"write_max_payload_size"`
+	ReadBufferSize       int           `yaml:"read_buffer_size" toml:"read_buffer_size"`
+	HandshakeTimeout     time.Duration `yaml:"handshake_timeout" toml:"handshake_timeout"`
+	MaxPushWait          time.Duration `yaml:"max_push_wait" toml:"max_push_wait"`
+	Protocol             string        `yaml:"protocol" toml:"protocol"`
+	ForwardHeaders       stringList    `yaml:"forward_headers" toml:"forward_headers"`
+	ForwardQuery         stringList    `yaml:"forward_query" toml:"forward_query"`
+	ForwardOnMessage     bool          `yaml:"forward_on_message" toml:"forward_on_message"`
+	ConnectResponse      string        `yaml:"connect_response" toml:"connect_response"`
+	BinaryContentTypes   stringList    `yaml:"binary_content_types" toml:"binary_content_types"`
+	DuplicatePolicy      string        `yaml:"duplicate_policy" toml:"duplicate_policy"`
+	DuplicateCloseCode   int           `yaml:"duplicate_close_code" toml:"duplicate_close_code"`
+	BroadcastConcurrency int           `yaml:"broadcast_concurrency" toml:"broadcast_concurrency"`
+	QueueTtl             time.Duration `yaml:"queue_ttl" toml:"queue_ttl"`
+	QueueDepth           int           `yaml:"queue_depth" toml:"queue_depth"`
+	QueueDir             string        `yaml:"queue_dir" toml:"queue_dir"`
+	QueueFsync           string        `yaml:"queue_fsync" toml:"queue_fsync"`
+	AckTimeout           time.Duration `yaml:"ack_timeout" toml:"ack_timeout"`
+	AckRetries           int           `yaml:"ack_retries" toml:"ack_retries"`
+	AckCallbackUrl       string        `yaml:"ack_callback_url" toml:"ack_callback_url"`
+	Retries              int           `yaml:"retries" toml:"retries"`
+	RetryBackoff         time.Duration `yaml:"retry_backoff" toml:"retry_backoff"`
+	RetryMaxBackoff      time.Duration `yaml:"retry_max_backoff" toml:"retry_max_backoff"`
+	BreakerThreshold     int           `yaml:"breaker_threshold" toml:"breaker_threshold"`
+	BreakerCooldown      time.Duration `yaml:"breaker_cooldown" toml:"breaker_cooldown"`
+	ShadowUrl            string        `yaml:"shadow_url" toml:"shadow_url"`
+	ShadowConcurrency    int           `yaml:"shadow_concurrency" toml:"shadow_concurrency"`
+	SigningKeys          stringList    `yaml:"signing_keys" toml:"signing_keys"`
+}
+
+// stringList is a list of strings that is given as a comma separated flag value
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = nil
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
+
+// defaultConfig returns the settings that were hardcoded before they became configurable
+func defaultConfig() Config {
+	return Config{
+		Listen:               ":7001",
+		AdminListen:          "",
+		AdminTlsCert:         "",
+		AdminTlsKey:          "",
+		AdminClientCa:        "",
+		Credentials:          []Credential{},
+		AuthMaxSkew:          5 * time.Minute,
+		AuthMaxBodySize:      16 * 1024 * 1024,
+		ServerUrl:            "http://localhost:8000/wsoverhttp/",
+		ServerUrls:           stringList{},
+		Balance:              "round-robin",
+		HealthCheckInterval:  0,
+		HealthCheckPath:      "",
+		EjectThreshold:       0,
+		EjectDuration:        30 * time.Second,
+		Routes:               []Route{},
+		MaxProcs:             8,
+		MaxConnsPerHost:      10000, // c10k I guess
+		MaxIdleConnsPerHost:  1000,  // just guessing
+		ClientTimeout:        60 * time.Second,
+		CheckUtf8Enabled:     true,
+		PermessageDeflate:    false,
+		ParallelEnabled:      true,
+		ParallelGolimit:      16,
+		ReadMaxPayloadSize:   16 * 1024 * 1024,
+		WriteMaxPayloadSize:  16 * 1024 * 1024,
+		ReadBufferSize:       4 * 1024,
+		HandshakeTimeout:     5 * time.Second,
+		MaxPushWait:          60 * time.Second,
+		ForwardHeaders:       stringList{},
+		ForwardQuery:         stringList{},
+		ConnectResponse:      "ok",
+		BinaryContentTypes:   stringList{"application/octet-stream"},
+		DuplicatePolicy:      "keep",
+		DuplicateCloseCode:   4000,
+		BroadcastConcurrency: 64,
+		QueueTtl:             0,
+		QueueDepth:           100,
+		QueueDir:             "",
+		QueueFsync:           "second",
+		AckTimeout:           0,
+		AckRetries:           0,
+		AckCallbackUrl:       "",
+		Retries:              0,
+		RetryBackoff:         100 * time.Millisecond,
+		RetryMaxBackoff:      5 * time.Second,
+		BreakerThreshold:     0,
+		BreakerCooldown:      10 * time.Second,
+		ShadowUrl:            "",
+		ShadowConcurrency:    64,
+		SigningKeys:          stringList{},
+	}
+}
+
+// registerFlags binds the config fields to flags, the flag names are the
+// config file keys with dashes instead of underscores
+func (c *Config) registerFlags(flags *flag.FlagSet) {
+	flags.StringVar(&c.Listen, "listen", c.Listen, "address to listen on")
+	flags.StringVar(&c.AdminListen, "admin-listen", c.AdminListen, "address (or \"unix:\" socket path) for the API, the public address then only accepts upgrades")
+	flags.StringVar(&c.AdminTlsCert, "admin-tls-cert", c.AdminTlsCert, "certificate file to serve the admin listener with TLS")
+	flags.StringVar(&c.AdminTlsKey, "admin-tls-key", c.AdminTlsKey, "private key file of the admin TLS certificate")
+	flags.StringVar(&c.AdminClientCa, "admin-client-ca", c.AdminClientCa, "CA file to verify the client certificates of the admin listener with")
+	flags.DurationVar(&c.AuthMaxSkew, "auth-max-skew", c.AuthMaxSkew, "maximum age of the timestamp of a signed API request")
+	flags.IntVar(&c.AuthMaxBodySize, "auth-max-body-size", c.AuthMaxBodySize, "maximum size of the body of a signed API request in bytes")
+	flags.StringVar(&c.ServerUrl, "server-url", c.ServerUrl, "url of the API server")
+	flags.Var(&c.ServerUrls, "server-urls", "comma separated urls of the API servers to balance across (overrides server-url)")
+	flags.StringVar(&c.Balance, "balance", c.Balance, "balancing across the API servers: \"round-robin\", \"least-inflight\" or \"hash\"")
+	flags.DurationVar(&c.HealthCheckInterval, "health-check-interval", c.HealthCheckInterval, "interval of the health checks of the API servers (0 = disabled)")
+	flags.StringVar(&c.HealthCheckPath, "health-check-path", c.HealthCheckPath, "path (relative to the server url) that is requested by the health check")
+	flags.IntVar(&c.EjectThreshold, "eject-threshold", c.EjectThreshold, "consecutive failures after which an API server is ejected (0 = disabled)")
+	flags.DurationVar(&c.EjectDuration, "eject-duration", c.EjectDuration, "time that an ejected API server is not used")
+	flags.IntVar(&c.MaxProcs, "max-procs", c.MaxProcs, "value for GOMAXPROCS (0 = number of CPUs)")
+	flags.IntVar(&c.MaxConnsPerHost, "max-conns-per-host", c.MaxConnsPerHost, "maximum number of connections to the API server")
+	flags.IntVar(&c.MaxIdleConnsPerHost, "max-idle-conns-per-host", c.MaxIdleConnsPerHost, "maximum number of idle connections to the API server")
+	flags.DurationVar(&c.ClientTimeout, "client-timeout", c.ClientTimeout, "timeout of requests to the API server")
+	flags.BoolVar(&c.CheckUtf8Enabled, "check-utf8-enabled", c.CheckUtf8Enabled, "check that text messages are valid UTF-8")
+	flags.BoolVar(&c.PermessageDeflate, "permessage-deflate", c.PermessageDeflate, "enable websocket compression")
+	flags.BoolVar(&c.ParallelEnabled, "parallel-enabled", c.ParallelEnabled, "handle messages of a connection in parallel")
+	flags.IntVar(&c.ParallelGolimit, "parallel-golimit", c.ParallelGolimit, "maximum number of parallel (or queued when ordered) messages per connection")
+	flags.BoolVar(&c.Ordered, "ordered", c.Ordered, "handle messages of a connection one by one and in order")
+	flags.IntVar(&c.ReadMaxPayloadSize, "read-max-payload-size", c.ReadMaxPayloadSize, "maximum size of a received message in bytes")
+	flags.IntVar(&c.WriteMaxPayloadSize, "write-max-payload-size", c.WriteMaxPayloadSize, "maximum size of a sent message in bytes")
+	flags.IntVar(&c.ReadBufferSize, "read-buffer-size", c.ReadBufferSize, "size of the read buffer per connection in bytes")
+	flags.DurationVar(&c.HandshakeTimeout, "handshake-timeout", c.HandshakeTimeout, "timeout of the websocket handshake")
+	flags.DurationVar(&c.MaxPushWait, "max-push-wait", c.MaxPushWait, "maximum wait time of a push that waits for the reply")
+	flags.StringVar(&c.Protocol, "protocol", c.Protocol, "message protocol: empty for any or \"ocpp\" for OCPP-J")
+	flags.Var(&c.ForwardHeaders, "forward-headers", "comma separated handshake headers that are sent to the API server")
+	flags.Var(&c.ForwardQuery, "forward-query", "comma separated handshake query parameters that are sent to the API server")
+	flags.BoolVar(&c.ForwardOnMessage, "forward-on-message", c.ForwardOnMessage, "also send the forwarded handshake metadata on every message and disconnect")
+	flags.StringVar(&c.ConnectResponse, "connect-response", c.ConnectResponse, "format of the connect response: \"ok\" or \"json\"")
+	flags.Var(&c.BinaryContentTypes, "binary-content-types", "comma separated content types that are sent as binary messages")
+	flags.StringVar(&c.DuplicatePolicy, "duplicate-policy", c.DuplicatePolicy, "policy for a second connection of a client: \"keep\", \"reject\" or \"takeover\"")
+	flags.IntVar(&c.DuplicateCloseCode, "duplicate-close-code", c.DuplicateCloseCode, "close code for connections that are replaced or rejected as duplicate")
+	flags.IntVar(&c.BroadcastConcurrency, "broadcast-concurrency", c.BroadcastConcurrency, "maximum number of concurrent writes of a broadcast")
+	flags.DurationVar(&c.QueueTtl, "queue-ttl", c.QueueTtl, "time that messages for offline clients are queued (0 = no queue)")
+	flags.IntVar(&c.QueueDepth, "queue-depth", c.QueueDepth, "maximum number of queued messages per offline client")
+	flags.StringVar(&c.QueueDir, "queue-dir", c.QueueDir, "directory to store queued messages in (empty = in memory)")
+	flags.StringVar(&c.QueueFsync, "queue-fsync", c.QueueFsync, "when to write queued messages to disk: \"always\", \"second\" or \"never\"")
+	flags.DurationVar(&c.AckTimeout, "ack-timeout", c.AckTimeout, "time to wait for the reply to a pushed CALL (0 = no tracking)")
+	flags.IntVar(&c.AckRetries, "ack-retries", c.AckRetries, "number of times a pushed CALL is retransmitted when there is no reply")
+	flags.StringVar(&c.AckCallbackUrl, "ack-callback-url", c.AckCallbackUrl, "url that the outcome of pushed CALLs is posted to")
+	flags.IntVar(&c.Retries, "retries", c.Retries, "number of retries of failed connect and disconnect requests to the API server")
+	flags.DurationVar(&c.RetryBackoff, "retry-backoff", c.RetryBackoff, "backoff before the first retry, doubled on every retry")
+	flags.DurationVar(&c.RetryMaxBackoff, "retry-max-backoff", c.RetryMaxBackoff, "maximum backoff between retries")
+	flags.IntVar(&c.BreakerThreshold, "breaker-threshold", c.BreakerThreshold, "consecutive failures of the API server that open the circuit breaker (0 = disabled)")
+	flags.DurationVar(&c.BreakerCooldown, "breaker-cooldown", c.BreakerCooldown, "time that the circuit breaker stays open before a request is let through")
+	flags.StringVar(&c.ShadowUrl, "shadow-url", c.ShadowUrl, "url of a shadow API server that requests are mirrored to (empty = disabled)")
+	flags.IntVar(&c.ShadowConcurrency, "shadow-concurrency", c.ShadowConcurrency, "maximum number of mirrored requests in progress, more are dropped")
+	flags.Var(&c.SigningKeys, "signing-keys", "comma separated \"<Id>:<Secret>\" keys that the requests to the API server are signed with (at most two)")
+}
+
+// loadFile reads a YAML or TOML file (based on the extension) into the config
+func (c *Config) loadFile(filename string) error {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return fmt.Errorf("loadFile: %s", err.Error())
+	}
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".yaml", ".yml":
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		err = decoder.Decode(c)
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("loadFile: %s: %s", filename, err.Error())
+		}
+	case ".toml":
+		metaData, err := toml.Decode(string(data), c)
+		if err != nil {
+			return fmt.Errorf("loadFile: %s: %s", filename, err.Error())
+		}
+		if undecoded := metaData.Undecoded(); len(undecoded) > 0 {
+			return fmt.Errorf("loadFile: %s: unknown key %q", filename, undecoded[0].String())
+		}
+	default:
+		return fmt.Errorf("loadFile: %s: unsupported extension (use .yaml, .yml or .toml)", filename)
+	}
+	return nil
+}
+
+// envName converts a flag name to the name of the environment variable
+func envName(flagName string) string {
+	return "WSPROXY_" + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// validate checks the config for values that can not work
+func (c *Config) validate() error {
+	if c.Listen == "" {
+		return fmt.Errorf("validate: listen may not be empty")
+	}
+	if c.AdminListen == c.Listen || c.AdminListen == "unix:" {
+		return fmt.Errorf("validate: admin_listen must be empty or another address than listen: %q", c.AdminListen)
+	}
+	if (c.AdminTlsCert == "") != (c.AdminTlsKey == "") || (c.AdminTlsCert != "" && c.AdminListen == "") {
+		return fmt.Errorf("validate: admin_tls_cert and admin_tls_key must be set together and require admin_listen")
+	}
+	if c.AdminClientCa != "" && c.AdminTlsCert == "" {
+		return fmt.Errorf("validate: admin_client_ca requires admin_tls_cert")
+	}
+	credentialNames := map[string]bool{}
+	for _, credential := range c.Credentials {
+		if err := credential.validate(); err != nil {
+			return err
+		}
+		if credential.ClientCert != "" && c.AdminClientCa == "" {
+			return fmt.Errorf("validate: credential %s: client_cert requires admin_client_ca", credential.Name)
+		}
+		if credentialNames[credential.Name] {
+			return fmt.Errorf("validate: credential names must be unique: %q", credential.Name)
+		}
+		credentialNames[credential.Name] = true
+	}
+	if c.AuthMaxSkew <= 0 || c.AuthMaxBodySize < 1 {
+		return fmt.Errorf("validate: auth_max_skew and auth_max_body_size must be positive")
+	}
+	serverUrl, err := url.Parse(c.ServerUrl)
+	if err != nil {
+		return fmt.Errorf("validate: server_url: %s", err.Error())
+	}
+	if (serverUrl.Scheme != "http" && serverUrl.Scheme != "https") || serverUrl.Host == "" {
+		return fmt.Errorf("validate: server_url must be an absolute http(s) url: %q", c.ServerUrl)
+	}
+	for _, value := range c.ServerUrls {
+		serverUrl, err := url.Parse(value)
+		if err != nil || (serverUrl.Scheme != "http" && serverUrl.Scheme != "https") || serverUrl.Host == "" {
+			return fmt.Errorf("validate: server_urls must be absolute http(s) urls: %q", value)
+		}
+	}
+	// the default route only has the "{id}" variable
+	for _, template := range append([]string{c.ServerUrl}, c.ServerUrls...) {
+		expanded, err := expandUrl(template, map[string]string{"id": "x"})
+		if err != nil {
+			return fmt.Errorf("validate: %s", err.Error())
+		}
+		if strings.ContainsAny(expanded, "{}") {
+			return fmt.Errorf("validate: server urls may only use the {id} variable: %q", template)
+		}
+	}
+	if c.Balance != "round-robin" && c.Balance != "least-inflight" && c.Balance != "hash" {
+		return fmt.Errorf("validate: balance must be \"round-robin\", \"least-inflight\" or \"hash\": %q", c.Balance)
+	}
+	names := map[string]bool{}
+	for _, route := range c.Routes {
+		if err := route.validate(); err != nil {
+			return err
+		}
+		if names[route.Name] {
+			return fmt.Errorf("validate: route names must be unique: %q", route.Name)
+		}
+		names[route.Name] = true
+	}
+	if c.HealthCheckInterval < 0 || c.EjectThreshold < 0 || c.EjectDuration < 0 {
+		return fmt.Errorf("validate: health_check_interval, eject_threshold and eject_duration may not be negative")
+	}
+	if c.MaxProcs < 0 {
+		return fmt.Errorf("validate: max_procs may not be negative")
+	}
+	if c.MaxConnsPerHost < 0 || c.MaxIdleConnsPerHost < 0 {
+		return fmt.Errorf("validate: max_conns_per_host and max_idle_conns_per_host may not be negative")
+	}
+	if c.ClientTimeout < 0 || c.HandshakeTimeout < 0 || c.MaxPushWait < 0 {
+		return fmt.Errorf("validate: client_timeout, handshake_timeout and max_push_wait may not be negative")
+	}
+	if c.Protocol != "" && c.Protocol != "ocpp" {
+		return fmt.Errorf("validate: protocol must be empty or \"ocpp\": %q", c.Protocol)
+	}
+	if c.ConnectResponse != "ok" && c.ConnectResponse != "json" {
+		return fmt.Errorf("validate: connect_response must be \"ok\" or \"json\": %q", c.ConnectResponse)
+	}
+	if c.DuplicatePolicy != "keep" && c.DuplicatePolicy != "reject" && c.DuplicatePolicy != "takeover" {
+		return fmt.Errorf("validate: duplicate_policy must be \"keep\", \"reject\" or \"takeover\": %q", c.DuplicatePolicy)
+	}
+	if c.DuplicateCloseCode < 1000 || c.DuplicateCloseCode > 4999 {
+		return fmt.Errorf("validate: duplicate_close_code must be between 1000 and 4999")
+	}
+	if c.BroadcastConcurrency < 1 {
+		return fmt.Errorf("validate: broadcast_concurrency must be at least 1")
+	}
+	if c.QueueTtl < 0 || c.QueueDepth < 1 {
+		return fmt.Errorf("validate: queue_ttl may not be negative and queue_depth must be at least 1")
+	}
+	if c.QueueDir != "" && c.QueueTtl == 0 {
+		return fmt.Errorf("validate: queue_dir requires queue_ttl")
+	}
+	if c.QueueFsync != "always" && c.QueueFsync != "second" && c.QueueFsync != "never" {
+		return fmt.Errorf("validate: queue_fsync must be \"always\", \"second\" or \"never\": %q", c.QueueFsync)
+	}
+	if c.AckTimeout < 0 || c.AckRetries < 0 {
+		return fmt.Errorf("validate: ack_timeout and ack_retries may not be negative")
+	}
+	if c.AckCallbackUrl != "" {
+		callbackUrl, err := url.Parse(c.AckCallbackUrl)
+		if err != nil || (callbackUrl.Scheme != "http" && callbackUrl.Scheme != "https") || callbackUrl.Host == "" {
+			return fmt.Errorf("validate: ack_callback_url must be an absolute http(s) url: %q", c.AckCallbackUrl)
+		}
+	}
+	if c.Retries < 0 || c.BreakerThreshold < 0 {
+		return fmt.Errorf("validate: retries and breaker_threshold may not be negative")
+	}
+	if c.RetryBackoff <= 0 || c.RetryMaxBackoff < c.RetryBackoff || c.BreakerCooldown <= 0 {
+		return fmt.Errorf("validate: retry_backoff and breaker_cooldown must be positive and retry_max_backoff at least retry_backoff")
+	}
+	if c.ShadowUrl != "" {
+		shadowUrl, err := url.Parse(c.ShadowUrl)
+		if err != nil || (shadowUrl.Scheme != "http" && shadowUrl.Scheme != "https") || shadowUrl.Host == "" {
+			return fmt.Errorf("validate: shadow_url must be an absolute http(s) url: %q", c.ShadowUrl)
+		}
+	}
+	if c.ShadowConcurrency < 1 {
+		return fmt.Errorf("validate: shadow_concurrency must be at least 1")
+	}
+	if len(c.SigningKeys) > 2 {
+		return fmt.Errorf("validate: signing_keys may have at most two keys")
+	}
+	for _, value := range c.SigningKeys {
+		id, secret, ok := strings.Cut(value, ":")
+		if !ok || id == "" || secret == "" || strings.ContainsAny(id, "=, ") {
+			return fmt.Errorf("validate: signing_keys must be \"<Id>:<Secret>\" with an id without \"=\", \",\" or spaces")
+		}
+	}
+	if c.ParallelGolimit < 1 {
+		return fmt.Errorf("validate: parallel_golimit must be at least 1")
+	}
+	if c.ReadMaxPayloadSize < 1 || c.WriteMaxPayloadSize < 1 || c.ReadBufferSize < 1 {
+		return fmt.Errorf("validate: payload and buffer sizes must be positive")
+	}
+	return nil
+}
+
+// loadConfig builds the config from defaults, the config file (set with
+// "-config" or WSPROXY_CONFIG), environment variables and the given arguments.
+// The returned boolean is true when the "-print-config" flag was given.
+func loadConfig(flags *flag.FlagSet, args []string) (Config, bool, error) {
+	config := defaultConfig()
+	config.registerFlags(flags)
+	configFile := flags.String("config", os.Getenv(envName("config")), "YAML or TOML config file")
+	printConfig := flags.Bool("print-config", false, "print the effective config (as YAML) and exit")
+	err := flags.Parse(args)
+	if err != nil {
+		return config, false, err
+	}
+	// remember the flags that were explicitly set
+	explicit := map[string]string{}
+	flags.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = f.Value.String()
+	})
+	if *configFile != "" {
+		err = config.loadFile(*configFile)
+		if err != nil {
+			return config, false, err
+		}
+	}
+	// environment variables override the config file
+	var envErr error
+	flags.VisitAll(func(f *flag.Flag) {
+		value, ok := os.LookupEnv(envName(f.Name))
+		if !ok || f.Name == "config" || envErr != nil {
+			return
+		}
+		if err := f.Value.Set(value); err != nil {
+			envErr = fmt.Errorf("loadConfig: %s: %s", envName(f.Name), err.Error())
+		}
+	})
+	if envErr != nil {
+		return config, false, envErr
+	}
+	// command-line flags override everything
+	for name, value := range explicit {
+		flags.Lookup(name).Value.Set(value)
+	}
+	err = config.validate()
+	if err != nil {
+		return config, false, err
+	}
+	return config, *printConfig, nil
+}
+
+// String returns the config in YAML format (without the secrets of the credentials and signing keys)
+func (c Config) String() string {
+	credentials := make([]Credential, len(c.Credentials))
+	for i, credential := range c.Credentials {
+		if credential.Token != "" {
+			credential.Token = "redacted"
+		}
+		if credential.HmacSecret != "" {
+			credential.HmacSecret = "redacted"
+		}
+		credentials[i] = credential
+	}
+	c.Credentials = credentials
+	signingKeys := stringList{}
+	for _, value := range c.SigningKeys {
+		id, _, _ := strings.Cut(value, ":")
+		signingKeys = append(signingKeys, id+":redacted")
+	}
+	c.SigningKeys = signingKeys
+	data, err := yaml.Marshal(c)
+	if err != nil {
+		return err.Error()
+	}
+	return string(data)
+}
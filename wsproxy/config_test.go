@@ -0,0 +1,123 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeConfigFile writes a config file with the given name and content in a temporary directory
+func writeConfigFile(t *testing.T, name, content string) string {
+	filename := filepath.Join(t.TempDir(), name)
+	err := os.WriteFile(filename, []byte(content), 0644)
+	if err != nil {
+		t.Fatalf("error writing config file: %s", err.Error())
+	}
+	return filename
+}
+
+// TestConfigPrecedence checks that flags override environment
+// variables, that override the config file, that overrides defaults.
+func TestConfigPrecedence(t *testing.T) {
+	filename := writeConfigFile(t, "wsproxy.yaml", "listen: \":7101\"\nserver_url: http://file/\nmax_procs: 2\nclient_timeout: 5s\n")
+	t.Setenv("WSPROXY_SERVER_URL", "http://env/")
+	t.Setenv("WSPROXY_MAX_PROCS", "3")
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	config, printConfig, err := loadConfig(flags, []string{"-config", filename, "-max-procs", "4"})
+	if err != nil {
+		t.Fatalf("error loading config: %s", err.Error())
+	}
+	got := fmt.Sprintf("%s %s %d %s %d %v", config.Listen, config.ServerUrl, config.MaxProcs, config.ClientTimeout, config.ParallelGolimit, printConfig)
+	want := ":7101 http://env/ 4 5s 16 false"
+	if got != want {
+		t.Errorf("got %q, wanted %q", got, want)
+	}
+}
+
+// TestConfigToml checks that a TOML config file is read and that
+// the effective config can be printed.
+func TestConfigToml(t *testing.T) {
+	filename := writeConfigFile(t, "wsproxy.toml", "server_url = \"https://api/\"\nparallel_enabled = false\n")
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	config, printConfig, err := loadConfig(flags, []string{"-config=" + filename, "--print-config"})
+	if err != nil {
+		t.Fatalf("error loading config: %s", err.Error())
+	}
+	output := config.String()
+	got := fmt.Sprintf("%v %v %v", printConfig, strings.Contains(output, "server_url: https://api/\n"), strings.Contains(output, "parallel_enabled: false\n"))
+	want := "true true true"
+	if got != want {
+		t.Errorf("got %q, wanted %q", got, want)
+	}
+}
+
+// TestConfigInvalid checks that unknown keys and invalid values are rejected.
+func TestConfigInvalid(t *testing.T) {
+	tests := []struct {
+		content string
+		args    []string
+		want    string
+	}{
+		{"unknown_key: 1\n", nil, "field unknown_key not found"},
+		{"server_url: localhost:8000\n", nil, "server_url must be an absolute http(s) url"},
+		{"server_url: http://api/{tenant}/\n", nil, "server urls may only use the {id} variable"},
+		{"", []string{"-parallel-golimit", "0"}, "parallel_golimit must be at least 1"},
+		{"queue_dir: /tmp/queue\n", nil, "queue_dir requires queue_ttl"},
+	}
+	for _, test := range tests {
+		filename := writeConfigFile(t, "wsproxy.yml", test.content)
+		flags := flag.NewFlagSet("test", flag.ContinueOnError)
+		_, _, err := loadConfig(flags, append([]string{"-config", filename}, test.args...))
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("got %v, wanted error containing %q", err, test.want)
+		}
+	}
+}
+
+// TestConfigServerUrlOrigin checks that server urls with user info or an
+// uppercase scheme are accepted and expanded.
+func TestConfigServerUrlOrigin(t *testing.T) {
+	config := defaultConfig()
+	config.ServerUrl = "HTTP://user:pw@api:8000/wsoverhttp/"
+	config.ServerUrls = stringList{"http://user:pw@api/{id}/"}
+	err := config.validate()
+	expanded, expandErr := expandUrl(config.ServerUrls[0], map[string]string{"id": "cp1"})
+	// compare results
+	got := fmt.Sprintf("%v %s %v", err, expanded, expandErr)
+	want := "<nil> http://user:pw@api/cp1/ <nil>"
+	if got != want {
+		t.Errorf("got %q, wanted %q", got, want)
+	}
+}
+
+// TestConfigRoutes checks that routes are read from a YAML config file and
+// that routes with variables that are not in the path are rejected.
+func TestConfigRoutes(t *testing.T) {
+	content := `routes:
+  - name: ocpp
+    path: /ocpp/{tenant}/{id}
+    variants:
+      - name: stable
+        weight: 90
+        server_urls: ["http://stable/{tenant}/"]
+      - name: canary
+        weight: 10
+        server_urls: ["http://canary/{tenant}/"]
+`
+	filename := writeConfigFile(t, "wsproxy.yaml", content)
+	config, _, err := loadConfig(flag.NewFlagSet("test", flag.ContinueOnError), []string{"-config", filename})
+	if err != nil {
+		t.Fatalf("error loading config: %s", err.Error())
+	}
+	filename = writeConfigFile(t, "invalid.yaml", strings.Replace(content, "{tenant}/\"]\n      - name: canary", "{site}/\"]\n      - name: canary", 1))
+	_, _, err = loadConfig(flag.NewFlagSet("test", flag.ContinueOnError), []string{"-config", filename})
+	// compare results
+	got := fmt.Sprintf("%d %s %d %v", len(config.Routes), config.Routes[0].Variants[1].ServerUrls, config.Routes[0].Variants[1].Weight, err)
+	want := `1 [http://canary/{tenant}/] 10 validate: route ocpp: server_urls must be absolute http(s) url templates: "http://stable/{site}/"`
+	if got != want {
+		t.Errorf("got %q, wanted %q", got, want)
+	}
+}
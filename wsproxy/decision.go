@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/http/httpguts"
+)
+
+// connectDecision is the decision of the API server on a connect request,
+// in "json" mode it is the response body, in "ok" mode it is derived from it
+type connectDecision struct {
+	Accept      bool              `json:"accept"`
+	Status      int               `json:"status"`
+	Body        string            `json:"body"`
+	Headers     map[string]string `json:"headers"`
+	Subprotocol string            `json:"subprotocol"`
+	Session     string            `json:"session"`
+	Attributes  map[string]string `json:"attributes"`
+}
+
+// parseConnectDecision reads the decision from the response of the API server
+func (c *Handler) parseConnectDecision(response string) (connectDecision, error) {
+	decision := connectDecision{}
+	if c.config.ConnectResponse == "json" && response != "ok" {
+		err := json.Unmarshal([]byte(response), &decision)
+		if err != nil {
+			return decision, fmt.Errorf("parseConnectDecision: %s", err.Error())
+		}
+	} else {
+		decision.Accept = response == "ok"
+	}
+	for key, value := range decision.Headers {
+		if !httpguts.ValidHeaderFieldName(key) || !httpguts.ValidHeaderFieldValue(value) {
+			return decision, fmt.Errorf("parseConnectDecision: invalid header: %q", key)
+		}
+		if isHandshakeHeader(key) {
+			delete(decision.Headers, key)
+		}
+	}
+	if !httpguts.ValidHeaderFieldValue(decision.Session) {
+		return decision, fmt.Errorf("parseConnectDecision: invalid session")
+	}
+	for key, value := range decision.Attributes {
+		if !httpguts.ValidHeaderFieldName("X-Session-"+key) || !httpguts.ValidHeaderFieldValue(value) {
+			return decision, fmt.Errorf("parseConnectDecision: invalid attribute: %q", key)
+		}
+	}
+	if !decision.Accept {
+		if decision.Status == 0 {
+			decision.Status = 403
+		}
+		if decision.Status < 400 || decision.Status > 599 {
+			return decision, fmt.Errorf("parseConnectDecision: status of a refusal must be 4xx or 5xx: %d", decision.Status)
+		}
+		if decision.Body == "" {
+			decision.Body = http.StatusText(decision.Status)
+		}
+	}
+	return decision, nil
+}
+
+// isHandshakeHeader tells whether a header is a hop-by-hop or handshake
+// header, the API server can not set these in the handshake response
+func isHandshakeHeader(key string) bool {
+	switch http.CanonicalHeaderKey(key) {
+	case "Connection", "Keep-Alive", "Proxy-Connection", "Te", "Trailer", "Transfer-Encoding", "Upgrade", "Content-Length":
+		return true
+	}
+	return strings.HasPrefix(http.CanonicalHeaderKey(key), "Sec-Websocket-")
+}
+
+// header returns the extra headers of the handshake response
+func (d connectDecision) header() http.Header {
+	header := http.Header{}
+	for key, value := range d.Headers {
+		header.Set(key, value)
+	}
+	return header
+}
+
+// sessionHeader returns the headers that attach the session to every request of the connection
+func (d connectDecision) sessionHeader() http.Header {
+	header := http.Header{}
+	if d.Session != "" {
+		header.Set("X-Session", d.Session)
+	}
+	for key, value := range d.Attributes {
+		header.Set("X-Session-"+key, value)
+	}
+	return header
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// groupNames returns the comma separated group names from the header values
+func groupNames(values []string) []string {
+	names := []string{}
+	for _, value := range values {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
+
+// joinGroup adds the connection of the client to a group, it returns false
+// when the connection has already ended
+func (c *Handler) joinGroup(client *Client, name string) bool {
+	client.groupsMutex.Lock()
+	defer client.groupsMutex.Unlock()
+	if client.groups == nil {
+		return false
+	}
+	client.groups[name] = struct{}{}
+	shard := c.groups.GetSharding(name)
+	shard.Lock()
+	defer shard.Unlock()
+	members, ok := shard.Load(name)
+	if !ok {
+		members = map[*Client]struct{}{}
+		shard.Store(name, members)
+	}
+	members[client] = struct{}{}
+	return true
+}
+
+// leaveGroup removes the connection of the client from a group
+func (c *Handler) leaveGroup(client *Client, name string) {
+	client.groupsMutex.Lock()
+	defer client.groupsMutex.Unlock()
+	delete(client.groups, name)
+	c.removeMember(name, client)
+}
+
+// leaveGroups removes the connection of the client from all its groups and
+// prevents it from joining new groups, it is called when the connection ends
+func (c *Handler) leaveGroups(client *Client) {
+	client.groupsMutex.Lock()
+	names := client.groups
+	client.groups = nil
+	client.groupsMutex.Unlock()
+	for name := range names {
+		c.removeMember(name, client)
+	}
+}
+
+// removeMember removes a connection from a group and removes empty groups
+func (c *Handler) removeMember(name string, client *Client) {
+	shard := c.groups.GetSharding(name)
+	shard.Lock()
+	defer shard.Unlock()
+	if members, ok := shard.Load(name); ok {
+		delete(members, client)
+		if len(members) == 0 {
+			shard.Delete(name)
+		}
+	}
+}
+
+// updateGroups applies the "X-Group-Join" and "X-Group-Leave" headers of a
+// response of the API server to the groups of the client
+func (c *Handler) updateGroups(client *Client, header http.Header) {
+	for _, name := range groupNames(header.Values("X-Group-Join")) {
+		c.joinGroup(client, name)
+	}
+	for _, name := range groupNames(header.Values("X-Group-Leave")) {
+		c.leaveGroup(client, name)
+	}
+}
+
+// groupMembers returns the sorted ClientIds of the members of a group
+func (c *Handler) groupMembers(name string) []string {
+	shard := c.groups.GetSharding(name)
+	shard.Lock()
+	members, _ := shard.Load(name)
+	unique := make(map[string]struct{}, len(members))
+	for client := range members {
+		unique[client.address] = struct{}{}
+	}
+	shard.Unlock()
+	addresses := make([]string, 0, len(unique))
+	for address := range unique {
+		addresses = append(addresses, address)
+	}
+	sort.Strings(addresses)
+	return addresses
+}
+
+// serveGroups pushes a message to the members of a group (POST /groups/<name>),
+// lists the members (GET /groups/<name>) or adds or removes a connected client
+// (PUT or DELETE /groups/<name>/<ClientId>)
+func (c *Handler) serveGroups(writer http.ResponseWriter, request *http.Request) {
+	parts := strings.SplitN(request.URL.Path, "/", 4)
+	if len(parts) < 3 || parts[2] == "" {
+		writer.WriteHeader(404)
+		writer.Write([]byte("not found"))
+		log.Println("serveGroups: no group name")
+		return
+	}
+	name := parts[2]
+	if len(parts) == 4 {
+		client, ok := c.connections.Load(parts[3])
+		if !ok {
+			writer.WriteHeader(404)
+			writer.Write([]byte("not found"))
+			log.Printf("serveGroups: could not find connection: %s", parts[3])
+			return
+		}
+		switch request.Method {
+		case http.MethodPut:
+			if !c.joinGroup(client, name) {
+				writer.WriteHeader(404)
+				writer.Write([]byte("not found"))
+				log.Printf("serveGroups: connection ended: %s", parts[3])
+				return
+			}
+		case http.MethodDelete:
+			c.leaveGroup(client, name)
+		default:
+			writer.WriteHeader(405)
+			writer.Write([]byte("method not allowed"))
+			return
+		}
+		writer.Write([]byte("ok"))
+		return
+	}
+	switch request.Method {
+	case http.MethodGet:
+		addresses := c.groupMembers(name)
+		writer.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(writer).Encode(connectionList{Count: len(addresses), ClientIds: addresses})
+	case http.MethodPost:
+		defer request.Body.Close()
+		bodyBytes, err := io.ReadAll(request.Body)
+		if err != nil {
+			writer.WriteHeader(500)
+			writer.Write([]byte("internal server error"))
+			log.Println("serveGroups: could not read body")
+			return
+		}
+		results := c.pushToMany(c.groupMembers(name), c.messageOpcode(request.Header.Get("Content-Type")), bodyBytes)
+		writer.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(writer).Encode(results)
+	default:
+		writer.WriteHeader(405)
+		writer.Write([]byte("method not allowed"))
+	}
+}
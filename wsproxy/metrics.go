@@ -0,0 +1,294 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lxzan/gws"
+)
+
+// upper bounds (in seconds) of the buckets of the latency histograms
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// startTime is reported as the start time of the process
+var startTime = time.Now()
+
+// directions of the message counters
+const (
+	directionIn  = 0 // received from the clients
+	directionOut = 1 // sent to the clients
+)
+
+// histogram counts observed durations in the latency buckets
+type histogram struct {
+	buckets []atomic.Uint64 // not cumulative, the last bucket is +Inf
+	count   atomic.Uint64
+	sum     atomic.Int64 // nanoseconds
+}
+
+// newHistogram creates a histogram with the latency buckets
+func newHistogram() *histogram {
+	return &histogram{buckets: make([]atomic.Uint64, len(latencyBuckets)+1)}
+}
+
+// observe counts a duration in its bucket
+func (h *histogram) observe(duration time.Duration) {
+	seconds := duration.Seconds()
+	i := sort.SearchFloat64s(latencyBuckets, seconds)
+	h.buckets[i].Add(1)
+	h.count.Add(1)
+	h.sum.Add(int64(duration))
+}
+
+// counterVec is a set of counters by their (formatted) labels, a counter
+// is created when it is first used
+type counterVec struct {
+	counters sync.Map
+}
+
+// add increments the counter with the given labels, e.g. `method="GET"`
+func (v *counterVec) add(labels string) {
+	counter, ok := v.counters.Load(labels)
+	if !ok {
+		counter, _ = v.counters.LoadOrStore(labels, new(atomic.Uint64))
+	}
+	counter.(*atomic.Uint64).Add(1)
+}
+
+// values returns the values of the counters by their labels
+func (v *counterVec) values() map[string]uint64 {
+	values := map[string]uint64{}
+	v.counters.Range(func(labels, counter any) bool {
+		values[labels.(string)] = counter.(*atomic.Uint64).Load()
+		return true
+	})
+	return values
+}
+
+// Metrics holds the metrics that are not kept in the statistics
+type Metrics struct {
+	messages     [2][2]atomic.Uint64   // by direction and opcode (text, binary)
+	latency      map[string]*histogram // by method of the request to the API server
+	responses    counterVec            // by method and status code
+	backendErrs  counterVec            // by method (no response)
+	pushRequests counterVec            // by endpoint of the push API
+	pushResults  counterVec            // by delivery result
+	authFailures counterVec            // by reason
+}
+
+// newMetrics creates the metrics with a latency histogram for every method
+func newMetrics() *Metrics {
+	metrics := &Metrics{latency: map[string]*histogram{}}
+	for _, method := range []string{"GET", "POST", "DELETE"} {
+		metrics.latency[method] = newHistogram()
+	}
+	return metrics
+}
+
+// message counts a text or binary message in the given direction
+func (m *Metrics) message(direction int, opcode gws.Opcode) {
+	if opcode == gws.OpcodeBinary {
+		m.messages[direction][1].Add(1)
+	} else {
+		m.messages[direction][0].Add(1)
+	}
+}
+
+// request counts a request to the API server by method and status code (0
+// when there was no response) and observes its latency
+func (m *Metrics) request(method string, status int, latency time.Duration) {
+	if h, ok := m.latency[method]; ok {
+		h.observe(latency)
+	}
+	if status == 0 {
+		m.backendErrs.add(`method="` + method + `"`)
+		return
+	}
+	m.responses.add(`method="` + method + `",code="` + strconv.Itoa(status) + `"`)
+}
+
+// pushRequest counts a request to an endpoint of the push API
+func (m *Metrics) pushRequest(endpoint string) {
+	m.pushRequests.add(`endpoint="` + endpoint + `"`)
+}
+
+// pushResult counts the delivery result of a pushed message
+func (m *Metrics) pushResult(result string) {
+	m.pushResults.add(`result="` + strings.ReplaceAll(result, " ", "_") + `"`)
+}
+
+// authFailure counts a request to the API that was not authorized
+func (m *Metrics) authFailure(reason string) {
+	m.authFailures.add(`reason="` + reason + `"`)
+}
+
+// metricsWriter writes metric families in the Prometheus text format or in
+// the OpenMetrics format (that names counter families without "_total")
+type metricsWriter struct {
+	writer      io.Writer
+	openMetrics bool
+}
+
+// family writes the HELP and TYPE lines of a metric family
+func (w *metricsWriter) family(name, kind, help string) {
+	if kind == "counter" && !w.openMetrics {
+		name += "_total"
+	}
+	fmt.Fprintf(w.writer, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// sample writes a sample with optional labels
+func (w *metricsWriter) sample(name, labels string, value string) {
+	if labels != "" {
+		name += "{" + labels + "}"
+	}
+	fmt.Fprintf(w.writer, "%s %s\n", name, value)
+}
+
+// counter writes a counter family with a single sample
+func (w *metricsWriter) counter(name, help string, value float64) {
+	w.family(name, "counter", help)
+	w.sample(name+"_total", "", strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+// gauge writes a gauge family with a single sample
+func (w *metricsWriter) gauge(name, help string, value float64) {
+	w.family(name, "gauge", help)
+	w.sample(name, "", strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+// counterVec writes a counter family with a sample for every label set (sorted)
+func (w *metricsWriter) counterVec(name, help string, vec *counterVec) {
+	w.family(name, "counter", help)
+	values := vec.values()
+	labels := make([]string, 0, len(values))
+	for label := range values {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	for _, label := range labels {
+		w.sample(name+"_total", label, strconv.FormatUint(values[label], 10))
+	}
+}
+
+// serveMetrics writes the metrics in the Prometheus text format, or in the
+// OpenMetrics format when the scraper accepts it (GET /metrics)
+func (c *Handler) serveMetrics(writer http.ResponseWriter, request *http.Request) {
+	w := &metricsWriter{writer: writer}
+	if strings.Contains(request.Header.Get("Accept"), "application/openmetrics-text") {
+		w.openMetrics = true
+		writer.Header().Set("Content-Type", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+	} else {
+		writer.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	}
+	m := c.metrics
+	// connections and messages
+	// kept duplicate connections are open too, so the registry is not counted
+	closed := atomic.LoadUint64(&c.statistics.connectionsClosed)
+	opened := atomic.LoadUint64(&c.statistics.connectionsOpened)
+	w.gauge("wsproxy_connections_active", "Number of open websocket connections.", float64(opened-closed))
+	w.counter("wsproxy_connections_opened", "Number of websocket connections that were opened.", float64(opened))
+	w.counter("wsproxy_connections_closed", "Number of websocket connections that were closed.", float64(closed))
+	w.family("wsproxy_messages", "counter", "Number of websocket messages by direction and opcode.")
+	for direction, directionName := range []string{"in", "out"} {
+		for opcode, opcodeName := range []string{"text", "binary"} {
+			labels := `direction="` + directionName + `",opcode="` + opcodeName + `"`
+			w.sample("wsproxy_messages_total", labels, strconv.FormatUint(m.messages[direction][opcode].Load(), 10))
+		}
+	}
+	// requests to the API server
+	w.counter("wsproxy_backend_requests_started", "Number of requests to the API server that were started.", float64(atomic.LoadUint64(&c.statistics.requestsStarted)))
+	w.counter("wsproxy_backend_requests_failed", "Number of requests to the API server that failed.", float64(atomic.LoadUint64(&c.statistics.requestsFailed)))
+	w.counter("wsproxy_backend_requests_succeeded", "Number of requests to the API server that succeeded.", float64(atomic.LoadUint64(&c.statistics.requestsSucceeded)))
+	w.counter("wsproxy_backend_requests_retried", "Number of requests to the API server that were retried.", float64(atomic.LoadUint64(&c.statistics.requestsRetried)))
+	w.counter("wsproxy_backend_requests_shed", "Number of requests to the API server that were failed fast by the circuit breaker.", float64(atomic.LoadUint64(&c.statistics.requestsShed)))
+	w.counterVec("wsproxy_backend_responses", "Number of responses of the API server by method and status code.", &m.responses)
+	w.counterVec("wsproxy_backend_errors", "Number of requests to the API server without a response by method.", &m.backendErrs)
+	w.family("wsproxy_backend_request_duration_seconds", "histogram", "Latency of the requests to the API server by method.")
+	for _, method := range []string{"GET", "POST", "DELETE"} {
+		h := m.latency[method]
+		cumulative := uint64(0)
+		for i := range h.buckets {
+			cumulative += h.buckets[i].Load()
+			le := "+Inf"
+			if i < len(latencyBuckets) {
+				le = strconv.FormatFloat(latencyBuckets[i], 'g', -1, 64)
+			}
+			w.sample("wsproxy_backend_request_duration_seconds_bucket", `method="`+method+`",le="`+le+`"`, strconv.FormatUint(cumulative, 10))
+		}
+		w.sample("wsproxy_backend_request_duration_seconds_count", `method="`+method+`"`, strconv.FormatUint(h.count.Load(), 10))
+		w.sample("wsproxy_backend_request_duration_seconds_sum", `method="`+method+`"`, strconv.FormatFloat(time.Duration(h.sum.Load()).Seconds(), 'g', -1, 64))
+	}
+	w.family("wsproxy_circuit_breaker_state", "gauge", "State of the circuit breaker of a route variant: 0 (closed), 1 (open) or 2 (half-open).")
+	for _, r := range c.routes {
+		for _, variant := range r.variants {
+			w.sample("wsproxy_circuit_breaker_state", `route="`+r.name+`",variant="`+variant.name+`"`, strconv.Itoa(variant.pool.breaker.getState()))
+		}
+	}
+	w.family("wsproxy_upstream_available", "gauge", "Whether the API server is healthy and not ejected.")
+	upstreams := c.upstreams()
+	for _, upstream := range upstreams {
+		available := "0"
+		if upstream.available(time.Now()) {
+			available = "1"
+		}
+		w.sample("wsproxy_upstream_available", `url="`+upstream.url+`"`, available)
+	}
+	w.family("wsproxy_upstream_inflight", "gauge", "Number of requests in progress to the API server.")
+	for _, upstream := range upstreams {
+		w.sample("wsproxy_upstream_inflight", `url="`+upstream.url+`"`, strconv.FormatInt(upstream.inflight.Load(), 10))
+	}
+	w.family("wsproxy_variant_requests", "counter", "Number of requests to the API servers of a route variant by result.")
+	for _, r := range c.routes {
+		for _, variant := range r.variants {
+			labels := `route="` + r.name + `",variant="` + variant.name + `",result=`
+			w.sample("wsproxy_variant_requests_total", labels+`"succeeded"`, strconv.FormatUint(variant.pool.succeeded.Load(), 10))
+			w.sample("wsproxy_variant_requests_total", labels+`"failed"`, strconv.FormatUint(variant.pool.failed.Load(), 10))
+		}
+	}
+	if c.config.ShadowUrl != "" {
+		w.family("wsproxy_shadow_requests", "counter", "Number of requests that were mirrored to the shadow API server by result.")
+		for _, result := range []struct {
+			name  string
+			value *uint64
+		}{{"match", &c.shadowStats.matches}, {"mismatch", &c.shadowStats.mismatches}, {"error", &c.shadowStats.errors}, {"dropped", &c.shadowStats.dropped}} {
+			w.sample("wsproxy_shadow_requests_total", `result="`+result.name+`"`, strconv.FormatUint(atomic.LoadUint64(result.value), 10))
+		}
+		w.gauge("wsproxy_shadow_latency_diff_seconds", "Sum of the latency of the shadow API server minus the latency of the primary API server.", float64(atomic.LoadInt64(&c.shadowStats.latencyDiff))/1000)
+	}
+	// push API
+	w.counterVec("wsproxy_push_requests", "Number of requests to the push API by endpoint.", &m.pushRequests)
+	w.counterVec("wsproxy_push_messages", "Number of pushed messages by delivery result.", &m.pushResults)
+	w.counterVec("wsproxy_auth_failures", "Number of requests to the API that were not authorized by reason.", &m.authFailures)
+	w.gauge("wsproxy_push_waiting", "Number of pushes that wait for the reply of the client.", float64(atomic.LoadInt64(&c.waiting)))
+	w.gauge("wsproxy_acks_pending", "Number of pushed CALLs that wait for an acknowledgement.", float64(atomic.LoadInt64(&c.tracking)))
+	// Go runtime and process
+	var memStats runtime.MemStats
+	runtime.ReadMemStats(&memStats)
+	w.family("go_info", "gauge", "Information about the Go environment.")
+	w.sample("go_info", `version="`+runtime.Version()+`"`, "1")
+	w.gauge("go_goroutines", "Number of goroutines that currently exist.", float64(runtime.NumGoroutine()))
+	w.gauge("go_memstats_alloc_bytes", "Number of bytes allocated and still in use.", float64(memStats.Alloc))
+	w.gauge("go_memstats_sys_bytes", "Number of bytes obtained from the system.", float64(memStats.Sys))
+	w.gauge("go_memstats_heap_inuse_bytes", "Number of heap bytes that are in use.", float64(memStats.HeapInuse))
+	w.gauge("go_memstats_heap_objects", "Number of allocated objects.", float64(memStats.HeapObjects))
+	w.counter("go_gc_cycles", "Number of completed GC cycles.", float64(memStats.NumGC))
+	w.counter("go_gc_pause_seconds", "Total time that the GC stopped the world.", time.Duration(memStats.PauseTotalNs).Seconds())
+	w.gauge("process_start_time_seconds", "Start time of the process since the unix epoch in seconds.", float64(startTime.UnixNano())/1e9)
+	if stats, ok := readProcessStats(); ok {
+		w.counter("process_cpu_seconds", "Total user and system CPU time spent in seconds.", stats.cpuTime.Seconds())
+		w.gauge("process_resident_memory_bytes", "Resident memory size in bytes.", float64(stats.residentMemory))
+		w.gauge("process_open_fds", "Number of open file descriptors.", float64(stats.openFds))
+	}
+	if w.openMetrics {
+		fmt.Fprint(writer, "# EOF\n")
+	}
+}
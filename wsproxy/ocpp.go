@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/lxzan/gws"
+)
+
+// OCPP-J message types (the first element of the message array)
+const (
+	ocppCall       = 2
+	ocppCallResult = 3
+	ocppCallError  = 4
+)
+
+// parseMessageId returns the message type and message id of an OCPP-J
+// message like [2,"id","action",{}], [3,"id",{}] or [4,"id","code","",{}]
+func parseMessageId(message string) (int, string, bool) {
+	if !strings.HasPrefix(strings.TrimLeft(message, " \t\r\n"), "[") {
+		return 0, "", false
+	}
+	var fields []json.RawMessage
+	if json.Unmarshal([]byte(message), &fields) != nil || len(fields) < 3 {
+		return 0, "", false
+	}
+	var messageType int
+	if json.Unmarshal(fields[0], &messageType) != nil {
+		return 0, "", false
+	}
+	var messageId string
+	if json.Unmarshal(fields[1], &messageId) != nil || messageId == "" {
+		return 0, "", false
+	}
+	return messageType, messageId, true
+}
+
+// ocppMessage holds the parsed envelope of an OCPP-J message
+type ocppMessage struct {
+	messageType int
+	messageId   string
+	action      string
+	errorCode   string
+}
+
+// ocppMessageTypeNames are the names of the message types as sent in the X-OCPP-Message-Type header
+var ocppMessageTypeNames = map[int]string{
+	ocppCall:       "CALL",
+	ocppCallResult: "CALLRESULT",
+	ocppCallError:  "CALLERROR",
+}
+
+// ocppError is a validation error that is reported to the client as a CALLERROR
+type ocppError struct {
+	messageId   string
+	errorCode   string
+	description string
+}
+
+func (e *ocppError) Error() string {
+	return "ocpp: " + e.errorCode + ": " + e.description
+}
+
+// isJsonObject checks whether a (valid) raw json value is an object
+func isJsonObject(value json.RawMessage) bool {
+	return strings.HasPrefix(strings.TrimLeft(string(value), " \t\r\n"), "{")
+}
+
+// parseOcppMessage parses and validates the envelope of an OCPP-J message
+func parseOcppMessage(message string) (ocppMessage, error) {
+	result := ocppMessage{}
+	var fields []json.RawMessage
+	if json.Unmarshal([]byte(message), &fields) != nil {
+		return result, &ocppError{"-1", "FormationViolation", "message is not a JSON array"}
+	}
+	if len(fields) < 3 || json.Unmarshal(fields[0], &result.messageType) != nil {
+		return result, &ocppError{"-1", "FormationViolation", "message has no message type"}
+	}
+	if json.Unmarshal(fields[1], &result.messageId) != nil || len(result.messageId) == 0 || len(result.messageId) > 36 {
+		return result, &ocppError{"-1", "FormationViolation", "message id must be a string of 1 to 36 characters"}
+	}
+	switch result.messageType {
+	case ocppCall:
+		if len(fields) != 4 {
+			return result, &ocppError{result.messageId, "FormationViolation", "call must have 4 elements"}
+		}
+		if json.Unmarshal(fields[2], &result.action) != nil || result.action == "" {
+			return result, &ocppError{result.messageId, "FormationViolation", "call must have an action"}
+		}
+		if !isJsonObject(fields[3]) {
+			return result, &ocppError{result.messageId, "FormationViolation", "call payload must be an object"}
+		}
+	case ocppCallResult:
+		if len(fields) != 3 {
+			return result, &ocppError{result.messageId, "FormationViolation", "callresult must have 3 elements"}
+		}
+		if !isJsonObject(fields[2]) {
+			return result, &ocppError{result.messageId, "FormationViolation", "callresult payload must be an object"}
+		}
+	case ocppCallError:
+		var errorDescription string
+		if len(fields) != 5 {
+			return result, &ocppError{result.messageId, "FormationViolation", "callerror must have 5 elements"}
+		}
+		if json.Unmarshal(fields[2], &result.errorCode) != nil || result.errorCode == "" {
+			return result, &ocppError{result.messageId, "FormationViolation", "callerror must have an error code"}
+		}
+		if json.Unmarshal(fields[3], &errorDescription) != nil {
+			return result, &ocppError{result.messageId, "FormationViolation", "callerror description must be a string"}
+		}
+		if !isJsonObject(fields[4]) {
+			return result, &ocppError{result.messageId, "FormationViolation", "callerror details must be an object"}
+		}
+	default:
+		return result, &ocppError{result.messageId, "ProtocolError", "unknown message type"}
+	}
+	return result, nil
+}
+
+// header returns the headers that describe the message to the API server
+func (m ocppMessage) header() http.Header {
+	header := http.Header{}
+	header.Set("X-OCPP-Message-Type", ocppMessageTypeNames[m.messageType])
+	header.Set("X-OCPP-Message-Id", m.messageId)
+	if m.action != "" {
+		header.Set("X-OCPP-Action", m.action)
+	}
+	if m.errorCode != "" {
+		header.Set("X-OCPP-Error-Code", m.errorCode)
+	}
+	return header
+}
+
+// ocppCallErrorMessage builds a CALLERROR message
+func ocppCallErrorMessage(messageId, errorCode, errorDescription string) string {
+	message, _ := json.Marshal([]any{ocppCallError, messageId, errorCode, errorDescription, struct{}{}})
+	return string(message)
+}
+
+// ocppErrorCode translates OCPP 1.6 error codes to their OCPP 2.x equivalent
+// when such a subprotocol was negotiated
+func ocppErrorCode(subprotocol, errorCode string) string {
+	if !strings.HasPrefix(subprotocol, "ocpp2") {
+		return errorCode
+	}
+	switch errorCode {
+	case "FormationViolation":
+		return "FormatViolation"
+	case "ProtocolError":
+		return "MessageTypeNotSupported"
+	}
+	return errorCode
+}
+
+// replyInternalError answers a CALL of the client with a CALLERROR when the
+// API server could not handle it
+func (c *Handler) replyInternalError(client *Client, message string) {
+	messageType, messageId, ok := parseMessageId(message)
+	if !ok || messageType != ocppCall {
+		return
+	}
+	err := client.writeMessage(gws.OpcodeText, []byte(ocppCallErrorMessage(messageId, "InternalError", "API server unavailable")))
+	if err != nil {
+		log.Println(err.Error())
+	}
+}
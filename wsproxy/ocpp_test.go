@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+// TestParseOcppMessage checks the validation of OCPP-J envelopes and the
+// headers that are sent to the API server.
+func TestParseOcppMessage(t *testing.T) {
+	tests := []struct {
+		message string
+		want    string
+	}{
+		{`[2,"123","Heartbeat",{}]`, "CALL 123 Heartbeat "},
+		{`[3,"123",{"currentTime":"2024-01-01T00:00:00Z"}]`, "CALLRESULT 123  "},
+		{`[4,"123","NotImplemented","",{}]`, "CALLERROR 123  NotImplemented"},
+		{`{"hello":"world"}`, "ocpp: FormationViolation: message is not a JSON array"},
+		{`[2,123,"Heartbeat",{}]`, "ocpp: FormationViolation: message id must be a string of 1 to 36 characters"},
+		{`[2,"123","Heartbeat"]`, "ocpp: FormationViolation: call must have 4 elements"},
+		{`[2,"123","",{}]`, "ocpp: FormationViolation: call must have an action"},
+		{`[3,"123",[]]`, "ocpp: FormationViolation: callresult payload must be an object"},
+		{`[4,"123","NotImplemented",{}]`, "ocpp: FormationViolation: callerror must have 5 elements"},
+		{`[5,"123",{}]`, "ocpp: ProtocolError: unknown message type"},
+	}
+	for _, test := range tests {
+		message, err := parseOcppMessage(test.message)
+		got := ""
+		if err != nil {
+			got = err.Error()
+		} else {
+			header := message.header()
+			got = fmt.Sprintf("%s %s %s %s", header.Get("X-OCPP-Message-Type"), header.Get("X-OCPP-Message-Id"), header.Get("X-OCPP-Action"), header.Get("X-OCPP-Error-Code"))
+		}
+		if got != test.want {
+			t.Errorf("got %q, wanted %q", got, test.want)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// processStats holds the resource usage of the process
+type processStats struct {
+	cpuTime        time.Duration
+	residentMemory int64
+	openFds        int
+}
+
+// readProcessStats reads the resource usage of the process from /proc
+func readProcessStats() (processStats, bool) {
+	stats := processStats{}
+	var usage syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &usage); err != nil {
+		return stats, false
+	}
+	stats.cpuTime = time.Duration(usage.Utime.Nano() + usage.Stime.Nano())
+	statm, err := os.ReadFile("/proc/self/statm")
+	if err != nil {
+		return stats, false
+	}
+	fields := strings.Fields(string(statm))
+	if len(fields) < 2 {
+		return stats, false
+	}
+	pages, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return stats, false
+	}
+	stats.residentMemory = pages * int64(os.Getpagesize())
+	fds, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		return stats, false
+	}
+	stats.openFds = len(fds)
+	return stats, true
+}
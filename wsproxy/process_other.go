@@ -0,0 +1,17 @@
+//go:build !linux
+
+package main
+
+import "time"
+
+// processStats holds the resource usage of the process
+type processStats struct {
+	cpuTime        time.Duration
+	residentMemory int64
+	openFds        int
+}
+
+// readProcessStats is not supported on this platform
+func readProcessStats() (processStats, bool) {
+	return processStats{}, false
+}
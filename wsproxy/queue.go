@@ -0,0 +1,295 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/lxzan/gws"
+)
+
+// delivery results of a message that is pushed to a client that is not connected
+const (
+	resultQueued    = "queued"
+	resultQueueFull = "queue full"
+)
+
+// queuedMessage is a message for a client that is not connected
+type queuedMessage struct {
+	id      uint64 // id in the queue store (when queue_dir is set)
+	opcode  gws.Opcode
+	payload []byte
+	expires time.Time
+}
+
+// unexpired returns the messages that have not expired, the expired messages
+// are acknowledged in the queue store
+func (c *Handler) unexpired(address string, messages []queuedMessage, now time.Time) []queuedMessage {
+	for i, message := range messages {
+		if message.expires.After(now) {
+			return messages[i:]
+		}
+		c.acknowledge(address, message)
+	}
+	return nil
+}
+
+// acknowledge removes a delivered or expired message from the queue store
+func (c *Handler) acknowledge(address string, message queuedMessage) {
+	if c.store == nil {
+		return
+	}
+	err := c.store.ack(address, message.id)
+	if err != nil {
+		log.Printf("acknowledge: %s", err.Error())
+	}
+}
+
+// openQueue loads the messages from the queue store in "queue_dir", they
+// are kept there until they are delivered or expire
+func (c *Handler) openQueue() error {
+	store, queues, err := openQueueStore(c.config.QueueDir, c.config.QueueFsync)
+	if err != nil {
+		return err
+	}
+	for address, messages := range queues {
+		c.queues.Store(address, messages)
+	}
+	c.store = store
+	return nil
+}
+
+// enqueue holds a message for a client that is not connected, it returns
+// "queued" or "queue full" (or "not connected" when queueing is disabled or
+// no client can connect with the ClientId)
+func (c *Handler) enqueue(address string, opcode gws.Opcode, payload []byte) string {
+	if c.config.QueueTtl <= 0 || address == "" || reservedClientIds[address] {
+		return resultNotConnected
+	}
+	now := time.Now()
+	shard := c.queues.GetSharding(address)
+	shard.Lock()
+	messages, _ := shard.Load(address)
+	messages = c.unexpired(address, messages, now)
+	if len(messages) >= c.config.QueueDepth {
+		shard.Unlock()
+		return resultQueueFull
+	}
+	message := queuedMessage{0, opcode, payload, now.Add(c.config.QueueTtl)}
+	if c.store != nil {
+		err := c.store.append(address, &message)
+		if err != nil {
+			shard.Unlock()
+			log.Printf("enqueue: %s", err.Error())
+			return resultWriteFailed
+		}
+	}
+	shard.Store(address, append(messages, message))
+	shard.Unlock()
+	// the client may have connected (and flushed) in the meantime
+	if client, ok := c.connections.Load(address); ok {
+		c.flushQueue(client)
+	}
+	return resultQueued
+}
+
+// flushQueue writes the queued messages of the client, the pushes to the
+// client wait until they are written
+func (c *Handler) flushQueue(client *Client) {
+	client.flushMutex.Lock()
+	defer client.flushMutex.Unlock()
+	c.writeQueue(client)
+}
+
+// writeQueue writes the unexpired queued messages of the client in order,
+// the messages that could not be written stay queued (the flushMutex of the
+// client must be held)
+func (c *Handler) writeQueue(client *Client) {
+	if c.config.QueueTtl <= 0 {
+		return
+	}
+	shard := c.queues.GetSharding(client.address)
+	shard.Lock()
+	messages, _ := shard.Load(client.address)
+	shard.Delete(client.address)
+	messages = c.unexpired(client.address, messages, time.Now())
+	shard.Unlock()
+	for i, message := range messages {
+		key, awaited := c.awaitReply(client, message)
+		err := c.writePush(client, message.opcode, message.payload)
+		if err != nil {
+			log.Printf("writeQueue: could not write message: %s", err.Error())
+			if awaited {
+				c.stopAwaiting(key, message)
+			}
+			shard.Lock()
+			queued, _ := shard.Load(client.address)
+			shard.Store(client.address, append(messages[i:], queued...))
+			shard.Unlock()
+			return
+		}
+		if !awaited {
+			c.acknowledge(client.address, message)
+		}
+	}
+}
+
+// unconfirmedCall is a queued CALL that is written to a connection of the
+// client and is kept in the queue store until the client replies to it
+type unconfirmedCall struct {
+	client  *Client
+	message queuedMessage
+}
+
+// awaitReply keeps a queued CALL in the queue store until the client replies
+// to it (or it expires), it returns false for other messages and without a
+// queue store, as these are acknowledged when they are written
+func (c *Handler) awaitReply(client *Client, message queuedMessage) (string, bool) {
+	if c.store == nil || message.opcode != gws.OpcodeText {
+		return "", false
+	}
+	messageType, messageId, ok := parseMessageId(string(message.payload))
+	if !ok || messageType != ocppCall {
+		return "", false
+	}
+	key := replyKey(client.address, messageId)
+	shard := c.unconfirmed.GetSharding(key)
+	shard.Lock()
+	if previous, ok := shard.Load(key); ok {
+		c.acknowledge(client.address, previous.message)
+	} else {
+		atomic.AddInt64(&c.confirming, 1)
+	}
+	shard.Store(key, unconfirmedCall{client, message})
+	shard.Unlock()
+	return key, true
+}
+
+// stopAwaiting removes a queued CALL that could not be written, it stays in
+// the queue store as it is queued again
+func (c *Handler) stopAwaiting(key string, message queuedMessage) {
+	shard := c.unconfirmed.GetSharding(key)
+	shard.Lock()
+	defer shard.Unlock()
+	if current, ok := shard.Load(key); ok && current.message.id == message.id {
+		shard.Delete(key)
+		atomic.AddInt64(&c.confirming, -1)
+	}
+}
+
+// confirmReply acknowledges the queued CALL in the queue store that a
+// CALLRESULT or CALLERROR of the client replies to
+func (c *Handler) confirmReply(address, message string) {
+	if atomic.LoadInt64(&c.confirming) == 0 {
+		return
+	}
+	messageType, messageId, ok := parseMessageId(message)
+	if !ok || (messageType != ocppCallResult && messageType != ocppCallError) {
+		return
+	}
+	key := replyKey(address, messageId)
+	shard := c.unconfirmed.GetSharding(key)
+	shard.Lock()
+	call, ok := shard.Load(key)
+	if ok {
+		shard.Delete(key)
+		atomic.AddInt64(&c.confirming, -1)
+	}
+	shard.Unlock()
+	if ok {
+		c.acknowledge(address, call.message)
+	}
+}
+
+// removeUnconfirmed removes the queued CALLs that match from the unconfirmed
+// CALLs and returns them
+func (c *Handler) removeUnconfirmed(match func(call unconfirmedCall) bool) []unconfirmedCall {
+	if atomic.LoadInt64(&c.confirming) == 0 {
+		return nil
+	}
+	keys := []string{}
+	c.unconfirmed.Range(func(key string, call unconfirmedCall) bool {
+		if match(call) {
+			keys = append(keys, key)
+		}
+		return true
+	})
+	calls := []unconfirmedCall{}
+	for _, key := range keys {
+		shard := c.unconfirmed.GetSharding(key)
+		shard.Lock()
+		call, ok := shard.Load(key)
+		if ok && match(call) {
+			shard.Delete(key)
+			atomic.AddInt64(&c.confirming, -1)
+			calls = append(calls, call)
+		}
+		shard.Unlock()
+	}
+	return calls
+}
+
+// expireUnconfirmed acknowledges the queued CALLs that expired before the
+// client replied to them
+func (c *Handler) expireUnconfirmed(now time.Time) {
+	calls := c.removeUnconfirmed(func(call unconfirmedCall) bool {
+		return !call.message.expires.After(now)
+	})
+	for _, call := range calls {
+		c.acknowledge(call.client.address, call.message)
+	}
+}
+
+// requeueUnconfirmed queues the CALLs that were written to a closed
+// connection and not replied to again (in front of the queued messages) and
+// writes them to the current connection of the client, if any
+func (c *Handler) requeueUnconfirmed(client *Client) {
+	calls := c.removeUnconfirmed(func(call unconfirmedCall) bool {
+		return call.client == client
+	})
+	if len(calls) == 0 {
+		return
+	}
+	sort.Slice(calls, func(i, j int) bool { return calls[i].message.id < calls[j].message.id })
+	messages := make([]queuedMessage, 0, len(calls))
+	for _, call := range calls {
+		messages = append(messages, call.message)
+	}
+	shard := c.queues.GetSharding(client.address)
+	shard.Lock()
+	queued, _ := shard.Load(client.address)
+	shard.Store(client.address, append(messages, queued...))
+	shard.Unlock()
+	if current, ok := c.connections.Load(client.address); ok {
+		c.flushQueue(current)
+	}
+}
+
+// expireQueues periodically removes the expired messages of clients that do not reconnect
+func (c *Handler) expireQueues() {
+	ticker := time.NewTicker(c.config.QueueTtl)
+	for range ticker.C {
+		now := time.Now()
+		c.expireUnconfirmed(now)
+		addresses := []string{}
+		c.queues.Range(func(address string, messages []queuedMessage) bool {
+			if len(messages) > 0 && !messages[0].expires.After(now) {
+				addresses = append(addresses, address)
+			}
+			return true
+		})
+		for _, address := range addresses {
+			shard := c.queues.GetSharding(address)
+			shard.Lock()
+			if messages, ok := shard.Load(address); ok {
+				if messages = c.unexpired(address, messages, now); len(messages) > 0 {
+					shard.Store(address, messages)
+				} else {
+					shard.Delete(address)
+				}
+			}
+			shard.Unlock()
+		}
+	}
+}
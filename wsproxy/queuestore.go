@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"hash/fnv"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lxzan/gws"
+)
+
+// number of segment files of the queue store, a client always uses the same one
+const queueStoreShards = 16
+
+// maximum size of a record, larger sizes are treated as corruption
+const queueMaxRecordSize = 1 << 30
+
+// minimum number of acknowledged records in a segment before it is compacted
+const queueCompactThreshold = 1024
+
+// kinds of records in a segment file
+const (
+	recordEnqueue = 'E'
+	recordAck     = 'A'
+)
+
+// queueRecord is a queued message or the acknowledgement of its delivery,
+// it is stored as [length uint32][crc32 uint32][body]
+type queueRecord struct {
+	kind    byte
+	id      uint64
+	address string
+	message queuedMessage
+}
+
+// encode serializes the record including its length and checksum
+func (r queueRecord) encode() []byte {
+	body := []byte{r.kind}
+	body = binary.BigEndian.AppendUint64(body, r.id)
+	if r.kind == recordEnqueue {
+		body = binary.BigEndian.AppendUint64(body, uint64(r.message.expires.UnixNano()))
+		body = append(body, byte(r.message.opcode))
+		body = binary.BigEndian.AppendUint16(body, uint16(len(r.address)))
+		body = append(body, r.address...)
+		body = append(body, r.message.payload...)
+	}
+	record := make([]byte, 8, 8+len(body))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(body)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(body))
+	return append(record, body...)
+}
+
+// readRecord reads the next record, a torn or corrupt record is an error
+func readRecord(reader io.Reader) (queueRecord, error) {
+	record := queueRecord{}
+	head := make([]byte, 8)
+	if _, err := io.ReadFull(reader, head); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return record, fmt.Errorf("readRecord: torn record")
+		}
+		return record, err
+	}
+	size := binary.BigEndian.Uint32(head[0:4])
+	if size < 9 || size > queueMaxRecordSize {
+		return record, fmt.Errorf("readRecord: corrupt record")
+	}
+	body := make([]byte, size)
+	if _, err := io.ReadFull(reader, body); err != nil {
+		return record, fmt.Errorf("readRecord: torn record")
+	}
+	if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(head[4:8]) {
+		return record, fmt.Errorf("readRecord: corrupt record")
+	}
+	record.kind = body[0]
+	record.id = binary.BigEndian.Uint64(body[1:9])
+	if record.kind == recordEnqueue {
+		if len(body) < 20 || len(body) < 20+int(binary.BigEndian.Uint16(body[18:20])) {
+			return record, fmt.Errorf("readRecord: corrupt record")
+		}
+		addressEnd := 20 + int(binary.BigEndian.Uint16(body[18:20]))
+		record.message.id = record.id
+		record.message.expires = time.Unix(0, int64(binary.BigEndian.Uint64(body[9:17])))
+		record.message.opcode = gws.Opcode(body[17])
+		record.address = string(body[20:addressEnd])
+		record.message.payload = body[addressEnd:]
+	}
+	return record, nil
+}
+
+// queueSegment is the append-only segment file of a shard of the queue store
+type queueSegment struct {
+	mutex sync.Mutex
+	path  string
+	file  *os.File
+	live  int  // enqueued records that are not acknowledged
+	acked int  // acknowledged records (and their acknowledgements)
+	dirty bool // written since the last fsync
+}
+
+// queueStore persists queued messages in segment files so that they survive
+// a restart, only OCPP-J CALLs are delivered at-least-once as they are
+// acknowledged when the client replies (and queued again when the connection
+// closes before that), other messages are delivered at most once as they are
+// acknowledged when they are written to the socket
+type queueStore struct {
+	segments []*queueSegment
+	fsync    string
+	lastId   atomic.Uint64
+}
+
+// openQueueStore opens (or creates) the segment files in the directory and
+// returns the queued messages per client that were not yet acknowledged
+func openQueueStore(dir, fsync string) (*queueStore, map[string][]queuedMessage, error) {
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, nil, fmt.Errorf("openQueueStore: %s", err.Error())
+	}
+	store := &queueStore{fsync: fsync}
+	queues := map[string][]queuedMessage{}
+	for i := 0; i < queueStoreShards; i++ {
+		segment := &queueSegment{path: filepath.Join(dir, fmt.Sprintf("queue-%02d.log", i))}
+		records, err := segment.replay()
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, record := range records {
+			queues[record.address] = append(queues[record.address], record.message)
+			if record.id > store.lastId.Load() {
+				store.lastId.Store(record.id)
+			}
+		}
+		err = segment.compact(records)
+		if err != nil {
+			return nil, nil, err
+		}
+		store.segments = append(store.segments, segment)
+	}
+	return store, queues, nil
+}
+
+// replay reads the segment file and returns the unexpired enqueued records
+// that are not acknowledged, it stops at the first torn or corrupt record
+func (s *queueSegment) replay() ([]queueRecord, error) {
+	file, err := os.Open(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("replay: %s", err.Error())
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+	records := map[uint64]queueRecord{}
+	for {
+		record, err := readRecord(reader)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Printf("replay: %s: %s", s.path, err.Error())
+			break
+		}
+		if record.kind == recordAck {
+			delete(records, record.id)
+		} else {
+			records[record.id] = record
+		}
+	}
+	now := time.Now()
+	result := []queueRecord{}
+	for _, record := range records {
+		if record.message.expires.After(now) {
+			result = append(result, record)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].id < result[j].id })
+	return result, nil
+}
+
+// compact replaces the segment file with one that only has the given records
+// and opens it for appending
+func (s *queueSegment) compact(records []queueRecord) error {
+	if s.file != nil {
+		s.file.Close()
+	}
+	file, err := os.Create(s.path + ".tmp")
+	if err != nil {
+		return fmt.Errorf("compact: %s", err.Error())
+	}
+	writer := bufio.NewWriter(file)
+	for _, record := range records {
+		writer.Write(record.encode())
+	}
+	err = writer.Flush()
+	if err == nil {
+		err = file.Sync()
+	}
+	file.Close()
+	if err == nil {
+		err = os.Rename(s.path+".tmp", s.path)
+	}
+	if err != nil {
+		return fmt.Errorf("compact: %s", err.Error())
+	}
+	s.file, err = os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("compact: %s", err.Error())
+	}
+	s.live = len(records)
+	s.acked = 0
+	s.dirty = false
+	return nil
+}
+
+// segment returns the segment file of the client
+func (s *queueStore) segment(address string) *queueSegment {
+	hash := fnv.New32a()
+	hash.Write([]byte(address))
+	return s.segments[hash.Sum32()%queueStoreShards]
+}
+
+// write appends a record to the segment and applies the fsync policy
+func (s *queueStore) write(segment *queueSegment, record queueRecord) error {
+	_, err := segment.file.Write(record.encode())
+	if err != nil {
+		return fmt.Errorf("write: %s", err.Error())
+	}
+	segment.dirty = true
+	if s.fsync == "always" {
+		segment.dirty = false
+		if err := segment.file.Sync(); err != nil {
+			return fmt.Errorf("write: %s", err.Error())
+		}
+	}
+	return nil
+}
+
+// append stores a queued message of the client and assigns its id
+func (s *queueStore) append(address string, message *queuedMessage) error {
+	if len(address) > 0xffff {
+		return fmt.Errorf("append: address too long")
+	}
+	segment := s.segment(address)
+	segment.mutex.Lock()
+	defer segment.mutex.Unlock()
+	message.id = s.lastId.Add(1)
+	err := s.write(segment, queueRecord{recordEnqueue, message.id, address, *message})
+	if err == nil {
+		segment.live++
+	}
+	return err
+}
+
+// ack stores that a message of the client is delivered (or dropped) and
+// compacts the segment when most of its records are acknowledged
+func (s *queueStore) ack(address string, id uint64) error {
+	segment := s.segment(address)
+	segment.mutex.Lock()
+	defer segment.mutex.Unlock()
+	err := s.write(segment, queueRecord{recordAck, id, address, queuedMessage{}})
+	if err != nil {
+		return err
+	}
+	segment.live--
+	segment.acked += 2
+	if segment.acked < queueCompactThreshold || segment.acked < segment.live {
+		return nil
+	}
+	segment.file.Sync()
+	records, err := segment.replay()
+	if err != nil {
+		return err
+	}
+	return segment.compact(records)
+}
+
+// syncLoop writes the segments to disk every second ("second" fsync policy)
+func (s *queueStore) syncLoop() {
+	ticker := time.NewTicker(time.Second)
+	for range ticker.C {
+		for _, segment := range s.segments {
+			segment.mutex.Lock()
+			if segment.dirty {
+				segment.dirty = false
+				if err := segment.file.Sync(); err != nil {
+					log.Printf("syncLoop: %s", err.Error())
+				}
+			}
+			segment.mutex.Unlock()
+		}
+	}
+}
+
+// close writes the segments to disk and closes them
+func (s *queueStore) close() error {
+	for _, segment := range s.segments {
+		segment.mutex.Lock()
+		segment.file.Sync()
+		err := segment.file.Close()
+		segment.mutex.Unlock()
+		if err != nil {
+			return fmt.Errorf("close: %s", err.Error())
+		}
+	}
+	return nil
+}
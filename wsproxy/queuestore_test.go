@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/lxzan/gws"
+)
+
+// TestQueueStore appends and acknowledges messages, corrupts the end of a
+// segment file and checks which messages are replayed after reopening.
+func TestQueueStore(t *testing.T) {
+	dir := t.TempDir()
+	store, _, err := openQueueStore(dir, "always")
+	if err != nil {
+		t.Fatalf("error opening queue store: %s", err.Error())
+	}
+	expires := time.Now().Add(time.Minute)
+	messages := []queuedMessage{
+		{0, gws.OpcodeText, []byte("one"), expires},
+		{0, gws.OpcodeBinary, []byte{0, 1}, expires},
+		{0, gws.OpcodeText, []byte("expired"), time.Now()},
+		{0, gws.OpcodeText, []byte("acked"), expires},
+	}
+	for i := range messages {
+		err = store.append("a1", &messages[i])
+		if err != nil {
+			t.Fatalf("error appending message: %s", err.Error())
+		}
+	}
+	store.ack("a1", messages[3].id)
+	store.close()
+	// append a torn record
+	file, _ := os.OpenFile(store.segment("a1").path, os.O_WRONLY|os.O_APPEND, 0o644)
+	file.Write(queueRecord{recordEnqueue, 9, "a1", messages[0]}.encode()[:12])
+	file.Close()
+	// reopen the store
+	store, queues, err := openQueueStore(dir, "always")
+	if err != nil {
+		t.Fatalf("error opening queue store: %s", err.Error())
+	}
+	defer store.close()
+	replayed := []string{}
+	for _, message := range queues["a1"] {
+		replayed = append(replayed, fmt.Sprintf("%d:%d:%q", message.id, message.opcode, message.payload))
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "*.log"))
+	// compare results
+	got := fmt.Sprintf("%v %d %d", replayed, store.lastId.Load(), len(files))
+	want := `[1:1:"one" 2:2:"\x00\x01"] 2 16`
+	if got != want {
+		t.Errorf("got %q, wanted %q", got, want)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// register stores the connection of a client, depending on the duplicate
+// policy an existing connection of the same client is closed (takeover),
+// kept (keep, it is used again when the new connection closes) or the new
+// connection is refused (reject), in which case false is returned
+func (c *Handler) register(client *Client) bool {
+	shard := c.connections.GetSharding(client.address)
+	shard.Lock()
+	previous, exists := shard.Load(client.address)
+	if exists && c.config.DuplicatePolicy == "reject" {
+		shard.Unlock()
+		return false
+	}
+	if exists && c.config.DuplicatePolicy == "keep" {
+		client.kept = previous
+	}
+	shard.Store(client.address, client)
+	shard.Unlock()
+	if exists && c.config.DuplicatePolicy == "takeover" {
+		previous.closedBy("proxy", "connection replaced")
+		previous.connection.WriteClose(uint16(c.config.DuplicateCloseCode), []byte("connection replaced"))
+	}
+	return true
+}
+
+// unregister removes the connection of a client, the older connections of
+// the same client that were kept take its place again (it may be called
+// more than once for the same connection)
+func (c *Handler) unregister(client *Client) {
+	shard := c.connections.GetSharding(client.address)
+	shard.Lock()
+	defer shard.Unlock()
+	current, ok := shard.Load(client.address)
+	if !ok {
+		return
+	}
+	if current == client {
+		if client.kept != nil {
+			shard.Store(client.address, client.kept)
+		} else {
+			shard.Delete(client.address)
+		}
+		return
+	}
+	for newer := current; newer.kept != nil; newer = newer.kept {
+		if newer.kept == client {
+			newer.kept = client.kept
+			return
+		}
+	}
+}
+
+// connectionInfo is the metadata of a connection as returned by the registry API
+type connectionInfo struct {
+	ClientId         string    `json:"clientId"`
+	RemoteAddr       string    `json:"remoteAddr"`
+	ConnectedAt      time.Time `json:"connectedAt"`
+	Subprotocol      string    `json:"subprotocol"`
+	MessagesReceived uint64    `json:"messagesReceived"`
+	MessagesSent     uint64    `json:"messagesSent"`
+	LastActivity     time.Time `json:"lastActivity"`
+}
+
+// connectionList is a page of connected ClientIds as returned by the registry API
+type connectionList struct {
+	Count     int      `json:"count"`
+	ClientIds []string `json:"clientIds"`
+	Next      string   `json:"next,omitempty"`
+}
+
+// serveConnections lists the connected ClientIds (GET /connections) or
+// returns the metadata of one connection (GET /connections/<ClientId>)
+func (c *Handler) serveConnections(writer http.ResponseWriter, request *http.Request) {
+	parts := strings.SplitN(request.URL.Path, "/", 3)
+	writer.Header().Set("Content-Type", "application/json")
+	if len(parts) == 3 && parts[2] != "" {
+		client, ok := c.connections.Load(parts[2])
+		if !ok {
+			writer.WriteHeader(404)
+			writer.Write([]byte("{}"))
+			return
+		}
+		json.NewEncoder(writer).Encode(connectionInfo{
+			ClientId:         client.address,
+			RemoteAddr:       client.remoteAddr,
+			ConnectedAt:      client.connectedAt,
+			Subprotocol:      client.connection.SubProtocol(),
+			MessagesReceived: client.messagesReceived.Load(),
+			MessagesSent:     client.messagesSent.Load(),
+			LastActivity:     time.Unix(0, client.lastActivity.Load()),
+		})
+		return
+	}
+	query := request.URL.Query()
+	prefix := query.Get("prefix")
+	after := query.Get("after")
+	limit := 100
+	if query.Has("limit") {
+		var err error
+		limit, err = strconv.Atoi(query.Get("limit"))
+		if err != nil || limit < 1 || limit > 10000 {
+			writer.WriteHeader(400)
+			writer.Write([]byte("{}"))
+			return
+		}
+	}
+	addresses := []string{}
+	c.connections.Range(func(address string, client *Client) bool {
+		if strings.HasPrefix(address, prefix) {
+			addresses = append(addresses, address)
+		}
+		return true
+	})
+	sort.Strings(addresses)
+	list := connectionList{Count: len(addresses), ClientIds: []string{}}
+	start := sort.SearchStrings(addresses, after)
+	if start < len(addresses) && addresses[start] == after {
+		start++
+	}
+	for i := start; i < len(addresses) && len(list.ClientIds) < limit; i++ {
+		list.ClientIds = append(list.ClientIds, addresses[i])
+	}
+	if start+len(list.ClientIds) < len(addresses) {
+		list.Next = list.ClientIds[len(list.ClientIds)-1]
+	}
+	json.NewEncoder(writer).Encode(list)
+}
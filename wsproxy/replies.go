@@ -0,0 +1,65 @@
+package main
+
+import (
+	"sync/atomic"
+)
+
+// replyKey identifies a server-to-client CALL by ClientId and message id
+func replyKey(address, messageId string) string {
+	return address + "\x00" + messageId
+}
+
+// waitForReply registers a channel that receives the client's CALLRESULT or
+// CALLERROR for the given message id, it returns false when someone is
+// already waiting for the same message id of this client
+func (c *Handler) waitForReply(address, messageId string) (chan string, bool) {
+	key := replyKey(address, messageId)
+	shard := c.replies.GetSharding(key)
+	shard.Lock()
+	defer shard.Unlock()
+	if _, ok := shard.Load(key); ok {
+		return nil, false
+	}
+	reply := make(chan string, 1)
+	shard.Store(key, reply)
+	atomic.AddInt64(&c.waiting, 1)
+	return reply, true
+}
+
+// stopWaiting removes the channel registered by waitForReply
+func (c *Handler) stopWaiting(address, messageId string, reply chan string) {
+	key := replyKey(address, messageId)
+	shard := c.replies.GetSharding(key)
+	shard.Lock()
+	defer shard.Unlock()
+	if current, ok := shard.Load(key); ok && current == reply {
+		shard.Delete(key)
+		atomic.AddInt64(&c.waiting, -1)
+	}
+}
+
+// deliverReply hands a CALLRESULT or CALLERROR to a waiting push request,
+// it returns false when nobody is waiting for the message
+func (c *Handler) deliverReply(address, message string) bool {
+	if atomic.LoadInt64(&c.waiting) == 0 {
+		return false
+	}
+	messageType, messageId, ok := parseMessageId(message)
+	if !ok || (messageType != ocppCallResult && messageType != ocppCallError) {
+		return false
+	}
+	key := replyKey(address, messageId)
+	shard := c.replies.GetSharding(key)
+	shard.Lock()
+	reply, ok := shard.Load(key)
+	if ok {
+		shard.Delete(key)
+		atomic.AddInt64(&c.waiting, -1)
+	}
+	shard.Unlock()
+	if !ok {
+		return false
+	}
+	reply <- message
+	return true
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// Route maps connections (by path, host and subprotocol) to API servers
+type Route struct {
+	Name        string     `yaml:"name" toml:"name"`
+	Path        string     `yaml:"path" toml:"path"`               // e.g. "/ocpp/{tenant}/{id}"
+	Host        string     `yaml:"host" toml:"host"`               // empty matches any host
+	Subprotocol string     `yaml:"subprotocol" toml:"subprotocol"` // empty matches any subprotocol
+	ClientId    string     `yaml:"client_id" toml:"client_id"`     // template, default "{id}"
+	ServerUrls  stringList `yaml:"server_urls" toml:"server_urls"` // url templates, e.g. "http://api/{tenant}/"
+	Variants    []Variant  `yaml:"variants" toml:"variants"`
+}
+
+// Variant is a weighted set of API servers of a route (e.g. "stable" and "canary")
+type Variant struct {
+	Name       string     `yaml:"name" toml:"name"`
+	Weight     int        `yaml:"weight" toml:"weight"`
+	ServerUrls stringList `yaml:"server_urls" toml:"server_urls"`
+}
+
+// routeVariant is a variant with its (runtime adjustable) weight and API servers
+type routeVariant struct {
+	name   string
+	weight atomic.Int64
+	pool   *upstreamPool
+}
+
+// route is a configured route, the last route is the default route that
+// takes the ClientId from the first path segment
+type route struct {
+	name        string
+	segments    []string
+	host        string
+	subprotocol string
+	clientId    string
+	variants    []*routeVariant
+}
+
+// expandTemplate replaces the "{name}" placeholders with the path variables
+// in a single pass, so the values of the variables are never expanded
+func expandTemplate(template string, vars map[string]string) string {
+	var expanded strings.Builder
+	for {
+		start := strings.Index(template, "{")
+		if start < 0 {
+			break
+		}
+		end := strings.Index(template[start:], "}") + start
+		if end < start {
+			break
+		}
+		if value, ok := vars[template[start+1:end]]; ok {
+			expanded.WriteString(template[:start])
+			expanded.WriteString(value)
+		} else {
+			expanded.WriteString(template[:end+1])
+		}
+		template = template[end+1:]
+	}
+	expanded.WriteString(template)
+	return expanded.String()
+}
+
+// isHostLabel tells whether a path variable can be used in the host of a
+// server url, it must be a single DNS label
+func isHostLabel(value string) bool {
+	if len(value) == 0 || len(value) > 63 {
+		return false
+	}
+	for _, r := range value {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// expandUrl expands a server url template with the path variables, they are
+// escaped in the path and must be DNS labels in the host, so that a client
+// can not change the scheme, host, query or fragment of the url
+func expandUrl(template string, vars map[string]string) (string, error) {
+	schemeEnd := strings.Index(template, "://") + 3
+	if schemeEnd < 3 {
+		return "", fmt.Errorf("expandUrl: invalid server url template: %q", template)
+	}
+	hostEnd := strings.Index(template[schemeEnd:], "/") + schemeEnd
+	if hostEnd < schemeEnd {
+		hostEnd = len(template)
+	}
+	host, path := template[:hostEnd], template[hostEnd:]
+	for name, value := range vars {
+		if strings.Contains(host, "{"+name+"}") {
+			if !isHostLabel(value) {
+				return "", fmt.Errorf("expandUrl: invalid host variable %s: %q", name, value)
+			}
+			host = strings.ReplaceAll(host, "{"+name+"}", value)
+		}
+		path = strings.ReplaceAll(path, "{"+name+"}", url.PathEscape(value))
+	}
+	base, err := url.Parse(host)
+	if err != nil {
+		return "", fmt.Errorf("expandUrl: invalid server url template: %q", template)
+	}
+	expanded, err := url.Parse(host + path)
+	if err != nil || !sameOrigin(base, expanded) {
+		return "", fmt.Errorf("expandUrl: server url does not keep its scheme and host: %q", host+path)
+	}
+	return host + path, nil
+}
+
+// sameOrigin tells whether two urls have the same scheme (in any case),
+// user info and host
+func sameOrigin(a, b *url.URL) bool {
+	return strings.EqualFold(a.Scheme, b.Scheme) && a.User.String() == b.User.String() && a.Host == b.Host
+}
+
+// validate checks that the route can be used
+func (r Route) validate() error {
+	if r.Name == "" || r.Name == "default" {
+		return fmt.Errorf("validate: routes must have a name other than \"default\"")
+	}
+	if !strings.HasPrefix(r.Path, "/") {
+		return fmt.Errorf("validate: route %s: path must start with \"/\": %q", r.Name, r.Path)
+	}
+	clientId := r.ClientId
+	if clientId == "" {
+		clientId = "{id}"
+	}
+	vars := map[string]string{}
+	for _, segment := range strings.Split(r.Path, "/")[1:] {
+		if strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}") {
+			vars[segment[1:len(segment)-1]] = "x"
+		}
+	}
+	if strings.ContainsAny(expandTemplate(clientId, vars), "{}/") {
+		return fmt.Errorf("validate: route %s: client_id uses variables that are not in the path: %q", r.Name, clientId)
+	}
+	if (len(r.ServerUrls) > 0) == (len(r.Variants) > 0) {
+		return fmt.Errorf("validate: route %s: must have either server_urls or variants", r.Name)
+	}
+	variants := r.Variants
+	if len(variants) == 0 {
+		variants = []Variant{{"default", 1, r.ServerUrls}}
+	}
+	total := 0
+	for _, variant := range variants {
+		if variant.Name == "" || variant.Weight < 0 || len(variant.ServerUrls) == 0 {
+			return fmt.Errorf("validate: route %s: variants must have a name, server_urls and a weight that is not negative", r.Name)
+		}
+		total += variant.Weight
+		for _, template := range variant.ServerUrls {
+			expanded, err := expandUrl(template, vars)
+			if err != nil {
+				return fmt.Errorf("validate: route %s: %s", r.Name, err.Error())
+			}
+			serverUrl, err := url.Parse(expanded)
+			if err != nil || (serverUrl.Scheme != "http" && serverUrl.Scheme != "https") || serverUrl.Host == "" || strings.ContainsAny(expanded, "{}") {
+				return fmt.Errorf("validate: route %s: server_urls must be absolute http(s) url templates: %q", r.Name, template)
+			}
+		}
+	}
+	if total == 0 {
+		return fmt.Errorf("validate: route %s: the total weight must be positive", r.Name)
+	}
+	return nil
+}
+
+// newRoutes creates the configured routes followed by the default route
+func newRoutes(config Config) []*route {
+	routes := []*route{}
+	for _, r := range config.Routes {
+		variants := r.Variants
+		if len(variants) == 0 {
+			variants = []Variant{{"default", 1, r.ServerUrls}}
+		}
+		clientId := r.ClientId
+		if clientId == "" {
+			clientId = "{id}"
+		}
+		rt := &route{name: r.Name, segments: strings.Split(r.Path, "/")[1:], host: r.Host, subprotocol: r.Subprotocol, clientId: clientId}
+		for _, v := range variants {
+			rt.variants = append(rt.variants, newRouteVariant(v.Name, v.Weight, v.ServerUrls, config))
+		}
+		routes = append(routes, rt)
+	}
+	serverUrls := config.ServerUrls
+	if len(serverUrls) == 0 {
+		serverUrls = stringList{config.ServerUrl}
+	}
+	defaultRoute := &route{name: "default", segments: []string{"{id}"}, clientId: "{id}"}
+	defaultRoute.variants = append(defaultRoute.variants, newRouteVariant("default", 1, serverUrls, config))
+	return append(routes, defaultRoute)
+}
+
+// newRouteVariant creates a variant with its API servers
+func newRouteVariant(name string, weight int, serverUrls []string, config Config) *routeVariant {
+	variant := &routeVariant{name: name, pool: newUpstreamPool(serverUrls, config)}
+	variant.weight.Store(int64(weight))
+	return variant
+}
+
+// match returns the path variables when the route matches the request, the
+// default route matches on the first path segment only
+func (r *route) match(request *http.Request) (map[string]string, bool) {
+	if r.host != "" {
+		host, _, err := net.SplitHostPort(request.Host)
+		if err != nil {
+			host = request.Host
+		}
+		if !strings.EqualFold(host, r.host) {
+			return nil, false
+		}
+	}
+	if r.subprotocol != "" {
+		if _, ok := selectSubprotocol(request, r.subprotocol); !ok {
+			return nil, false
+		}
+	}
+	segments := strings.Split(request.URL.Path, "/")[1:]
+	if r.name == "default" {
+		segments = segments[:1]
+	}
+	if len(segments) != len(r.segments) {
+		return nil, false
+	}
+	vars := map[string]string{}
+	for i, segment := range r.segments {
+		if strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}") {
+			if segments[i] == "" {
+				return nil, false
+			}
+			vars[segment[1:len(segment)-1]] = segments[i]
+		} else if segments[i] != segment {
+			return nil, false
+		}
+	}
+	return vars, true
+}
+
+// pickVariant chooses a variant by weight, a client always gets the same
+// variant as long as the weights do not change
+func (r *route) pickVariant(address string) *routeVariant {
+	if len(r.variants) == 1 {
+		return r.variants[0]
+	}
+	weights := make([]int64, len(r.variants))
+	total := int64(0)
+	for i, variant := range r.variants {
+		weights[i] = variant.weight.Load()
+		total += weights[i]
+	}
+	if total <= 0 {
+		return r.variants[0]
+	}
+	point := int64(hashString(r.name+"\x00"+address)) % total
+	for i, weight := range weights {
+		if point < weight {
+			return r.variants[i]
+		}
+		point -= weight
+	}
+	return r.variants[len(r.variants)-1]
+}
+
+// matchRoute returns the first route that matches the request with its path variables
+func (c *Handler) matchRoute(request *http.Request) (*route, map[string]string) {
+	for _, r := range c.routes {
+		if vars, ok := r.match(request); ok {
+			return r, vars
+		}
+	}
+	return nil, nil
+}
+
+// routeInfo is a route with its variants as returned by the routes API
+type routeInfo struct {
+	Name     string        `json:"name"`
+	Variants []variantInfo `json:"variants"`
+}
+
+// variantInfo is a variant with its weight and request counters
+type variantInfo struct {
+	Name      string `json:"name"`
+	Weight    int64  `json:"weight"`
+	Succeeded uint64 `json:"succeeded"`
+	Failed    uint64 `json:"failed"`
+}
+
+// serveRoutes lists the routes with the weights and counters of the variants
+// (GET /routes) or changes the weight of a variant (PUT /routes/<Route>/<Variant>?weight=<Weight>)
+func (c *Handler) serveRoutes(writer http.ResponseWriter, request *http.Request) {
+	parts := strings.Split(request.URL.Path, "/")
+	if request.Method == http.MethodPut && len(parts) == 4 {
+		weight, err := strconv.Atoi(request.URL.Query().Get("weight"))
+		if err != nil || weight < 0 {
+			writer.WriteHeader(400)
+			writer.Write([]byte("invalid weight"))
+			log.Printf("serveRoutes: invalid weight: %s", request.URL.Query().Get("weight"))
+			return
+		}
+		for _, r := range c.routes {
+			for _, variant := range r.variants {
+				if r.name == parts[2] && variant.name == parts[3] {
+					variant.weight.Store(int64(weight))
+					writer.Write([]byte("ok"))
+					return
+				}
+			}
+		}
+		writer.WriteHeader(404)
+		writer.Write([]byte("not found"))
+		log.Printf("serveRoutes: could not find variant: %s/%s", parts[2], parts[3])
+		return
+	}
+	if request.Method != http.MethodGet {
+		writer.WriteHeader(405)
+		writer.Write([]byte("method not allowed"))
+		return
+	}
+	routes := []routeInfo{}
+	for _, r := range c.routes {
+		info := routeInfo{Name: r.name, Variants: []variantInfo{}}
+		for _, variant := range r.variants {
+			info.Variants = append(info.Variants, variantInfo{
+				Name:      variant.name,
+				Weight:    variant.weight.Load(),
+				Succeeded: variant.pool.succeeded.Load(),
+				Failed:    variant.pool.failed.Load(),
+			})
+		}
+		routes = append(routes, info)
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(writer).Encode(routes)
+}
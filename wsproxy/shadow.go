@@ -0,0 +1,95 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// ShadowStatistics counts the requests that are mirrored to the shadow API server
+type ShadowStatistics struct {
+	requests    uint64
+	matches     uint64
+	mismatches  uint64
+	errors      uint64
+	dropped     uint64
+	latencyDiff int64 // sum of the shadow latency minus the primary latency in milliseconds
+}
+
+// shadowResult is the response of the primary API server that the shadow response is compared with
+type shadowResult struct {
+	status  int // 0 when there was no response
+	body    string
+	latency time.Duration
+}
+
+// truncate shortens a response body for logging
+func truncate(body string) string {
+	if len(body) > 200 {
+		return body[:200] + "..."
+	}
+	return body
+}
+
+// mirror sends a copy of a request to the API server to the "shadow_url"
+// (replacing the scheme and host) in the background and compares the
+// response with the response of the primary API server
+func (c *Handler) mirror(method, requestUrl, body string, header http.Header, primary shadowResult) {
+	if c.config.ShadowUrl == "" {
+		return
+	}
+	select {
+	case c.shadowSlots <- struct{}{}:
+	default:
+		atomic.AddUint64(&c.shadowStats.dropped, 1)
+		return
+	}
+	go func() {
+		defer func() { <-c.shadowSlots }()
+		atomic.AddUint64(&c.shadowStats.requests, 1)
+		target, err := url.Parse(requestUrl)
+		if err != nil {
+			atomic.AddUint64(&c.shadowStats.errors, 1)
+			return
+		}
+		shadowUrl, _ := url.Parse(c.config.ShadowUrl)
+		target.Scheme = shadowUrl.Scheme
+		target.Host = shadowUrl.Host
+		req, err := http.NewRequest(method, target.String(), strings.NewReader(body))
+		if err != nil {
+			atomic.AddUint64(&c.shadowStats.errors, 1)
+			return
+		}
+		for key, values := range header {
+			req.Header[key] = values
+		}
+		req.Header.Set("X-Shadow", "1")
+		c.signRequest(req, body)
+		start := time.Now()
+		r, err := c.shadowClient.Do(req)
+		if err != nil {
+			atomic.AddUint64(&c.shadowStats.errors, 1)
+			log.Printf("mirror: %s", err.Error())
+			return
+		}
+		defer r.Body.Close()
+		responseBytes, err := io.ReadAll(r.Body)
+		latency := time.Since(start)
+		if err != nil {
+			atomic.AddUint64(&c.shadowStats.errors, 1)
+			log.Printf("mirror: %s", err.Error())
+			return
+		}
+		atomic.AddInt64(&c.shadowStats.latencyDiff, (latency - primary.latency).Milliseconds())
+		if r.StatusCode == primary.status && string(responseBytes) == primary.body {
+			atomic.AddUint64(&c.shadowStats.matches, 1)
+			return
+		}
+		atomic.AddUint64(&c.shadowStats.mismatches, 1)
+		log.Printf("mirror: mismatch %s %s: primary %d %q, shadow %d %q", method, target.Path, primary.status, truncate(primary.body), r.StatusCode, truncate(string(responseBytes)))
+	}()
+}
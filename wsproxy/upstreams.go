@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// number of points of every upstream on the consistent hash ring
+const upstreamRingPoints = 100
+
+// upstream is one of the API servers that requests are balanced across
+type upstream struct {
+	url          string
+	inflight     atomic.Int64
+	failures     atomic.Int64 // consecutive failures (for passive ejection)
+	ejectedUntil atomic.Int64 // unix time in nanoseconds
+	healthy      atomic.Bool  // result of the last active health check
+	pool         *upstreamPool
+}
+
+// ringPoint is a point of an upstream on the consistent hash ring
+type ringPoint struct {
+	hash     uint32
+	upstream *upstream
+}
+
+// upstreamPool balances the requests to the API servers using "round-robin",
+// "least-inflight" or "hash" (consistent hashing on the ClientId), every pool
+// (route variant) has its own circuit breaker
+type upstreamPool struct {
+	upstreams      []*upstream
+	balance        string
+	next           atomic.Uint64
+	ring           []ringPoint
+	ejectThreshold int
+	ejectDuration  time.Duration
+	succeeded      atomic.Uint64
+	failed         atomic.Uint64
+	breaker        *circuitBreaker
+}
+
+// hashString returns the 32 bit FNV-1a hash of a string, mixed with the
+// murmur3 finalizer for a better spread of similar strings on the ring
+func hashString(value string) uint32 {
+	hash := fnv.New32a()
+	hash.Write([]byte(value))
+	h := hash.Sum32()
+	h ^= h >> 16
+	h *= 0x85ebca6b
+	h ^= h >> 13
+	h *= 0xc2b2ae35
+	h ^= h >> 16
+	return h
+}
+
+// newUpstreamPool creates the pool with the given (templates of) server urls
+func newUpstreamPool(urls []string, config Config) *upstreamPool {
+	pool := &upstreamPool{
+		balance:        config.Balance,
+		ejectThreshold: config.EjectThreshold,
+		ejectDuration:  config.EjectDuration,
+		breaker:        &circuitBreaker{threshold: config.BreakerThreshold, cooldown: config.BreakerCooldown},
+	}
+	for _, url := range urls {
+		u := &upstream{url: url, pool: pool}
+		u.healthy.Store(true)
+		pool.upstreams = append(pool.upstreams, u)
+		for i := 0; i < upstreamRingPoints; i++ {
+			pool.ring = append(pool.ring, ringPoint{hashString(fmt.Sprintf("%s#%d", url, i)), u})
+		}
+	}
+	sort.Slice(pool.ring, func(i, j int) bool { return pool.ring[i].hash < pool.ring[j].hash })
+	return pool
+}
+
+// available tells whether the upstream is healthy and not ejected
+func (u *upstream) available(now time.Time) bool {
+	return u.healthy.Load() && now.UnixNano() >= u.ejectedUntil.Load()
+}
+
+// pick returns the upstream for a request of the client, when no upstream is
+// available all upstreams are used
+func (p *upstreamPool) pick(address string) *upstream {
+	if len(p.upstreams) == 1 {
+		return p.upstreams[0]
+	}
+	now := time.Now()
+	candidates := make([]*upstream, 0, len(p.upstreams))
+	for _, u := range p.upstreams {
+		if u.available(now) {
+			candidates = append(candidates, u)
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = p.upstreams
+	}
+	switch p.balance {
+	case "least-inflight":
+		offset := p.next.Add(1)
+		best := candidates[offset%uint64(len(candidates))]
+		for i := range candidates {
+			u := candidates[(offset+uint64(i))%uint64(len(candidates))]
+			if u.inflight.Load() < best.inflight.Load() {
+				best = u
+			}
+		}
+		return best
+	case "hash":
+		hash := hashString(address)
+		start := sort.Search(len(p.ring), func(i int) bool { return p.ring[i].hash >= hash })
+		for i := 0; i < len(p.ring); i++ {
+			u := p.ring[(start+i)%len(p.ring)].upstream
+			if len(candidates) == len(p.upstreams) || u.available(now) {
+				return u
+			}
+		}
+	}
+	return candidates[(p.next.Add(1)-1)%uint64(len(candidates))]
+}
+
+// record counts the result of a request to the upstream and ejects it for
+// "eject_duration" after "eject_threshold" consecutive failures (no response
+// or a 5xx response)
+func (p *upstreamPool) record(u *upstream, err error) {
+	if err != nil {
+		p.failed.Add(1)
+	} else {
+		p.succeeded.Add(1)
+	}
+	if p.ejectThreshold <= 0 {
+		return
+	}
+	if !retryable(err) {
+		u.failures.Store(0)
+		return
+	}
+	if u.failures.Add(1) >= int64(p.ejectThreshold) {
+		u.failures.Store(0)
+		u.ejectedUntil.Store(time.Now().Add(p.ejectDuration).UnixNano())
+		log.Printf("record: upstream ejected: %s", u.url)
+	}
+}
+
+// upstreams returns the upstreams of all routes
+func (c *Handler) upstreams() []*upstream {
+	upstreams := []*upstream{}
+	for _, r := range c.routes {
+		for _, variant := range r.variants {
+			upstreams = append(upstreams, variant.pool.upstreams...)
+		}
+	}
+	return upstreams
+}
+
+// checkHealth requests the "health_check_path" of every upstream every
+// "health_check_interval", upstreams that do not respond with a 200 are
+// not used until they do (url templates are not checked)
+func (c *Handler) checkHealth() {
+	client := &http.Client{Timeout: c.config.HealthCheckInterval}
+	ticker := time.NewTicker(c.config.HealthCheckInterval)
+	for range ticker.C {
+		for _, u := range c.upstreams() {
+			if strings.Contains(u.url, "{") {
+				continue
+			}
+			healthy := false
+			response, err := client.Get(u.url + c.config.HealthCheckPath)
+			if err == nil {
+				healthy = response.StatusCode == 200
+				response.Body.Close()
+			}
+			if u.healthy.Swap(healthy) != healthy {
+				log.Printf("checkHealth: upstream %s healthy: %v", u.url, healthy)
+			}
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// TestUpstreamPool checks the balancing across upstreams and that ejected
+// and unhealthy upstreams are skipped.
+func TestUpstreamPool(t *testing.T) {
+	config := defaultConfig()
+	config.ServerUrls = stringList{"http://a/", "http://b/", "http://c/"}
+	config.EjectThreshold = 2
+	// round robin
+	pool := newUpstreamPool(config.ServerUrls, config)
+	roundRobin := ""
+	for i := 0; i < 4; i++ {
+		roundRobin += pool.pick("x").url[7:8]
+	}
+	// least inflight
+	config.Balance = "least-inflight"
+	pool = newUpstreamPool(config.ServerUrls, config)
+	pool.upstreams[0].inflight.Store(2)
+	pool.upstreams[2].inflight.Store(1)
+	leastInflight := pool.pick("x").url[7:8]
+	// consistent hash
+	config.Balance = "hash"
+	pool = newUpstreamPool(config.ServerUrls, config)
+	sticky := true
+	counts := map[string]int{}
+	for i := 0; i < 300; i++ {
+		address := fmt.Sprintf("cp%d", i)
+		u := pool.pick(address)
+		sticky = sticky && pool.pick(address) == u
+		counts[u.url]++
+	}
+	balanced := counts["http://a/"] > 50 && counts["http://b/"] > 50 && counts["http://c/"] > 50
+	// eject after two failures and skip unhealthy
+	upstream := pool.pick("cp1")
+	pool.record(upstream, &fetchError{502, "502 Bad Gateway"})
+	pool.record(upstream, errors.New("not retryable"))
+	pool.record(upstream, &fetchError{0, "connection refused"})
+	notEjected := pool.pick("cp1") == upstream
+	pool.record(upstream, &fetchError{0, "connection refused"})
+	ejected := pool.pick("cp1") != upstream
+	for _, u := range pool.upstreams {
+		u.healthy.Store(false)
+	}
+	failOpen := pool.pick("cp1") == upstream
+	// compare results
+	got := fmt.Sprintf("%s %s %v %v %v %v %v %d %d", roundRobin, leastInflight, sticky, balanced, notEjected, ejected, failOpen, pool.succeeded.Load(), pool.failed.Load())
+	want := "abca b true true true true true 0 4"
+	if got != want {
+		t.Errorf("got %q, wanted %q", got, want)
+	}
+}
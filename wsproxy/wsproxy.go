@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"mime"
 	"net/http"
 	"os"
 	"runtime"
@@ -17,10 +18,6 @@ import (
 	"github.com/lxzan/gws"
 )
 
-func init() {
-	runtime.GOMAXPROCS(8)
-}
-
 var (
 	rps   uint64 = 0
 	conns uint64 = 0
@@ -41,7 +38,17 @@ var memprofile = flag.String("memprofile", "", "write mem profile to file")
 // }
 
 func main() {
-	flag.Parse()
+	config, printConfig, err := loadConfig(flag.CommandLine, os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
+	if printConfig {
+		fmt.Print(config.String())
+		return
+	}
+	if config.MaxProcs > 0 {
+		runtime.GOMAXPROCS(config.MaxProcs)
+	}
 	if *cpuprofile != "" {
 		f, err := os.Create(*cpuprofile)
 		if err != nil {
@@ -52,28 +59,82 @@ func main() {
 	}
 	//increaseNumberOfOpenFiles()
 	go printStatistics()
-	log.Println("Proxy running on: http://localhost:7001/")
-	log.Panic(http.ListenAndServe(":7001", getWsHandler("http://localhost:8000/wsoverhttp/")))
+	handler := newHandler(config)
+	// the queue store is opened before the queues expire
+	if config.QueueDir != "" {
+		err := handler.openQueue()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if config.QueueFsync == "second" {
+			go handler.store.syncLoop()
+		}
+	}
+	if config.QueueTtl > 0 {
+		go handler.expireQueues()
+	}
+	if config.HealthCheckInterval > 0 {
+		go handler.checkHealth()
+	}
+	if config.AdminListen != "" {
+		listener, err := listenAdmin(config.AdminListen)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Admin running on: %s", config.AdminListen)
+		go func() {
+			log.Panic(serveAdmin(handler, listener))
+		}()
+		log.Printf("Proxy running on: %s", config.Listen)
+		log.Panic(http.ListenAndServe(config.Listen, publicHandler{handler}))
+	}
+	log.Printf("Proxy running on: %s", config.Listen)
+	log.Panic(http.ListenAndServe(config.Listen, handler))
 }
 
+// getWsHandler returns a handler with the default config for the given API server url
 func getWsHandler(serverUrl string) http.Handler {
+	config := defaultConfig()
+	config.ServerUrl = serverUrl
+	return newHandler(config)
+}
+
+func newHandler(config Config) *Handler {
 	handler := Handler{
-		connections: gws.NewConcurrentMap[string, *gws.Conn](16),
-		addresses:   gws.NewConcurrentMap[*gws.Conn, string](16),
+		connections: gws.NewConcurrentMap[string, *Client](16),
+		addresses:   gws.NewConcurrentMap[*gws.Conn, *Client](16),
+		replies:     gws.NewConcurrentMap[string, chan string](16),
+		groups:      gws.NewConcurrentMap[string, map[*Client]struct{}](16),
+		queues:      gws.NewConcurrentMap[string, []queuedMessage](16),
+		store:       nil,
+		acks:        gws.NewConcurrentMap[string, *pendingAck](16),
+		unconfirmed: gws.NewConcurrentMap[string, unconfirmedCall](16),
 		upgrader:    nil,
-		serverUrl:   serverUrl,
+		upgraders:   gws.NewConcurrentMap[string, *gws.Upgrader](16),
+		config:      config,
+		routes:      newRoutes(config),
 		statistics:  Statistics{},
 		client:      nil,
+		shadowSlots: make(chan struct{}, config.ShadowConcurrency),
+		metrics:     newMetrics(),
+		auth:        newAuthenticator(config),
+		signingKeys: parseSigningKeys(config.SigningKeys),
 	}
 	serverOptions := gws.ServerOption{
-		CheckUtf8Enabled:  true,
-		Recovery:          gws.Recovery,
-		PermessageDeflate: gws.PermessageDeflate{Enabled: false},
-		ParallelEnabled:   true,
-		ParallelGolimit:   16,
+		CheckUtf8Enabled:    config.CheckUtf8Enabled,
+		Recovery:            gws.Recovery,
+		PermessageDeflate:   gws.PermessageDeflate{Enabled: config.PermessageDeflate},
+		ParallelEnabled:     config.ParallelEnabled && !config.Ordered,
+		ParallelGolimit:     config.ParallelGolimit,
+		ReadMaxPayloadSize:  config.ReadMaxPayloadSize,
+		WriteMaxPayloadSize: config.WriteMaxPayloadSize,
+		ReadBufferSize:      config.ReadBufferSize,
+		HandshakeTimeout:    config.HandshakeTimeout,
 	}
+	handler.serverOptions = serverOptions
 	handler.upgrader = gws.NewUpgrader(&handler, &serverOptions)
 	handler.client = handler.httpClient()
+	handler.shadowClient = handler.httpClient()
 	return &handler
 }
 
@@ -95,69 +156,213 @@ type Statistics struct {
 	requestsSucceeded uint64
 	connectionsOpened uint64
 	connectionsClosed uint64
+	requestsRetried   uint64
+	requestsShed      uint64
 }
 
 type Handler struct {
 	gws.BuiltinEventHandler
-	connections *gws.ConcurrentMap[string, *gws.Conn]
-	addresses   *gws.ConcurrentMap[*gws.Conn, string]
-	upgrader    *gws.Upgrader
-	serverUrl   string
-	statistics  Statistics
-	client      *http.Client
+	connections   *gws.ConcurrentMap[string, *Client]
+	addresses     *gws.ConcurrentMap[*gws.Conn, *Client]
+	replies       *gws.ConcurrentMap[string, chan string]
+	groups        *gws.ConcurrentMap[string, map[*Client]struct{}]
+	queues        *gws.ConcurrentMap[string, []queuedMessage]
+	store         *queueStore
+	acks          *gws.ConcurrentMap[string, *pendingAck]
+	tracking      int64
+	unconfirmed   *gws.ConcurrentMap[string, unconfirmedCall]
+	confirming    int64
+	waiting       int64
+	upgrader      *gws.Upgrader
+	upgraders     *gws.ConcurrentMap[string, *gws.Upgrader]
+	serverOptions gws.ServerOption
+	config        Config
+	routes        []*route
+	statistics    Statistics
+	client        *http.Client
+	shadowSlots   chan struct{}
+	shadowStats   ShadowStatistics
+	shadowClient  *http.Client
+	metrics       *Metrics
+	auth          *authenticator
+	signingKeys   []signingKey
 }
 
 func (c *Handler) httpClient() *http.Client {
 	client := &http.Client{
 		Transport: &http.Transport{
-			MaxConnsPerHost:     10000, // c10k I guess
-			MaxIdleConnsPerHost: 1000,  // just guessing
+			MaxConnsPerHost:     c.config.MaxConnsPerHost,
+			MaxIdleConnsPerHost: c.config.MaxIdleConnsPerHost,
 		},
-		Timeout: 60 * time.Second,
+		Timeout: c.config.ClientTimeout,
 	}
 	return client
 }
 
-func (c *Handler) fetchData(client *http.Client, method, url, body string) (string, error) {
+// fetchData does a request to the API server, the upstream (nil for other urls)
+// tracks the requests in progress and the failures of the API server (in the
+// circuit breaker of its pool) and mirrors the request to the shadow API server
+func (c *Handler) fetchData(client *http.Client, upstream *upstream, method, url, body string, header http.Header) (string, http.Header, error) {
 	var r *http.Response
 	var err error
 	req, err := http.NewRequest(method, url, strings.NewReader(body))
 	if err != nil {
-		return "", err
+		return "", nil, err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	c.signRequest(req, body)
+	if upstream != nil && !upstream.pool.breaker.allow() {
+		atomic.AddUint64(&c.statistics.requestsShed, 1)
+		return "", nil, errCircuitOpen
+	}
+	if upstream != nil {
+		upstream.inflight.Add(1)
+		defer upstream.inflight.Add(-1)
 	}
 	atomic.AddUint64(&c.statistics.requestsStarted, 1)
+	start := time.Now()
 	r, err = client.Do(req)
 	//log.Printf("curl %s %s", url, body)
 	if err != nil {
+		c.metrics.request(method, 0, time.Since(start))
+		if upstream != nil {
+			c.mirror(method, url, body, header, shadowResult{0, "", time.Since(start)})
+		}
 		atomic.AddUint64(&c.statistics.requestsFailed, 1)
-		return "", fmt.Errorf("fetchData: %s", err.Error())
+		err = &fetchError{0, err.Error()}
+		c.recordUpstream(upstream, err)
+		return "", nil, err
 	}
 	defer r.Body.Close()
 	responseBytes, err := io.ReadAll(r.Body)
 	responseString := string(responseBytes)
 	//log.Printf("return %d %s", r.StatusCode, responseBytes)
+	c.metrics.request(method, r.StatusCode, time.Since(start))
+	if upstream != nil {
+		c.mirror(method, url, body, header, shadowResult{r.StatusCode, responseString, time.Since(start)})
+	}
 	if err != nil {
 		atomic.AddUint64(&c.statistics.requestsFailed, 1)
-		return responseString, fmt.Errorf("fetchData: %s", err.Error())
+		err = &fetchError{0, err.Error()}
+		c.recordUpstream(upstream, err)
+		return responseString, r.Header, err
 	}
 	if r.StatusCode != 200 {
 		atomic.AddUint64(&c.statistics.requestsFailed, 1)
-		return responseString, fmt.Errorf("fetchData: %s", r.Status)
+		err = &fetchError{r.StatusCode, r.Status}
+		c.recordUpstream(upstream, err)
+		return responseString, r.Header, err
 	}
 	atomic.AddUint64(&c.statistics.requestsSucceeded, 1)
-	return responseString, nil
+	c.recordUpstream(upstream, nil)
+	return responseString, r.Header, nil
+}
+
+// recordUpstream records the result of a request to an upstream, the results
+// of requests to other urls do not count for the circuit breaker
+func (c *Handler) recordUpstream(upstream *upstream, err error) {
+	if upstream != nil {
+		upstream.pool.breaker.record(err)
+		upstream.pool.record(upstream, err)
+	}
+}
+
+// getUpgrader returns an upgrader that responds with the given subprotocol
+// and extra headers, upgraders without extra headers are reused
+func (c *Handler) getUpgrader(subprotocol string, header http.Header) *gws.Upgrader {
+	if len(header) > 0 {
+		serverOptions := c.serverOptions
+		serverOptions.ResponseHeader = header
+		if subprotocol != "" {
+			serverOptions.SubProtocols = []string{subprotocol}
+		}
+		return gws.NewUpgrader(c, &serverOptions)
+	}
+	if subprotocol == "" {
+		return c.upgrader
+	}
+	upgrader, ok := c.upgraders.Load(subprotocol)
+	if !ok {
+		serverOptions := c.serverOptions
+		serverOptions.SubProtocols = []string{subprotocol}
+		upgrader = gws.NewUpgrader(c, &serverOptions)
+		c.upgraders.Store(subprotocol, upgrader)
+	}
+	return upgrader
 }
 
+// selectSubprotocol returns the subprotocol chosen by the API server, it
+// must be one of the subprotocols offered by the client
+func selectSubprotocol(request *http.Request, selected string) (string, bool) {
+	if selected == "" {
+		return "", true
+	}
+	for _, offered := range strings.Split(request.Header.Get("Sec-WebSocket-Protocol"), ",") {
+		if strings.TrimSpace(offered) == selected {
+			return selected, true
+		}
+	}
+	return "", false
+}
+
+// ServeHTTP serves the websocket upgrades and the API on the same listener
 func (c *Handler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	if c.serveApi(writer, request) {
+		return
+	}
+	c.serveConnect(writer, request)
+}
+
+// serveApi serves the push API, statistics, metrics and connection management,
+// it returns false when the request is not an API request
+func (c *Handler) serveApi(writer http.ResponseWriter, request *http.Request) bool {
 	address := strings.Split(request.URL.Path, "/")[1]
+	if address == "groups" && request.Header.Get("Upgrade") != "websocket" {
+		scope := scopeReadStats
+		if request.Method == http.MethodPost {
+			scope = scopePush
+			c.metrics.pushRequest("groups")
+		} else if request.Method != http.MethodGet {
+			scope = scopeManage
+		}
+		if !c.authorize(writer, request, scope) {
+			return true
+		}
+		c.serveGroups(writer, request)
+		return true
+	}
+	if request.Method == http.MethodPost && address == "batch" {
+		c.metrics.pushRequest("batch")
+		if !c.authorize(writer, request, scopePush) {
+			return true
+		}
+		c.batch(writer, request)
+		return true
+	}
+	if request.Method == http.MethodPost && address == "broadcast" {
+		c.metrics.pushRequest("broadcast")
+		if !c.authorize(writer, request, scopePush) {
+			return true
+		}
+		c.broadcast(writer, request)
+		return true
+	}
 	if request.Method == http.MethodPost {
-		// find connection
-		connection, ok := c.connections.Load(address)
-		if !ok {
+		c.metrics.pushRequest("push")
+		if !c.authorize(writer, request, scopePush) {
+			return true
+		}
+		// find connection, no client can connect with a reserved ClientId so
+		// messages for it are not queued
+		client, ok := c.connections.Load(address)
+		if !ok && (c.config.QueueTtl <= 0 || request.URL.Query().Has("wait") || address == "" || reservedClientIds[address]) {
+			c.metrics.pushResult(resultNotConnected)
 			writer.WriteHeader(404)
 			writer.Write([]byte("not found"))
 			log.Printf("MethodPost: could not find connection: %s", address)
-			return
+			return true
 		}
 		defer request.Body.Close()
 		bodyBytes, err := io.ReadAll(request.Body)
@@ -165,22 +370,84 @@ func (c *Handler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
 			writer.WriteHeader(500)
 			writer.Write([]byte("internal server error"))
 			log.Println("MethodPost: could not read body")
-			return
+			return true
 		}
-		err = connection.WriteString(string(bodyBytes))
+		if !ok {
+			result := c.enqueue(address, c.messageOpcode(request.Header.Get("Content-Type")), bodyBytes)
+			c.metrics.pushResult(result)
+			if result == resultWriteFailed {
+				writer.WriteHeader(500)
+				writer.Write([]byte("could not queue message"))
+				log.Printf("MethodPost: could not queue message: %s", address)
+				return true
+			}
+			if result != resultQueued {
+				writer.WriteHeader(503)
+				writer.Write([]byte("queue full"))
+				log.Printf("MethodPost: queue full: %s", address)
+				return true
+			}
+			writer.Write([]byte("queued"))
+			return true
+		}
+		if request.URL.Query().Has("wait") {
+			c.pushAndWait(writer, request, client, string(bodyBytes))
+			return true
+		}
+		err = c.push(client, c.messageOpcode(request.Header.Get("Content-Type")), bodyBytes)
 		if err != nil {
+			c.metrics.pushResult(resultWriteFailed)
 			log.Println("MethodPost: could not write message")
+		} else {
+			c.metrics.pushResult(resultDelivered)
 		}
 		writer.Write([]byte("ok"))
-		return
+		return true
+	}
+	if request.Method == http.MethodDelete {
+		c.metrics.pushRequest("disconnect")
+		if !c.authorize(writer, request, scopeDisconnect) {
+			return true
+		}
+		c.disconnect(writer, request, address)
+		return true
 	}
 	// parse address
 	if len(address) == 0 {
+		if !c.authorize(writer, request, scopeReadStats) {
+			return true
+		}
 		writer.Write([]byte("connections_opened " + strconv.FormatUint(atomic.LoadUint64(&c.statistics.connectionsOpened), 10) + "\n"))
 		writer.Write([]byte("connections_closed " + strconv.FormatUint(atomic.LoadUint64(&c.statistics.connectionsClosed), 10) + "\n"))
 		writer.Write([]byte("requests_started " + strconv.FormatUint(atomic.LoadUint64(&c.statistics.requestsStarted), 10) + "\n"))
 		writer.Write([]byte("requests_failed " + strconv.FormatUint(atomic.LoadUint64(&c.statistics.requestsFailed), 10) + "\n"))
 		writer.Write([]byte("requests_succeeded " + strconv.FormatUint(atomic.LoadUint64(&c.statistics.requestsSucceeded), 10) + "\n"))
+		writer.Write([]byte("requests_retried " + strconv.FormatUint(atomic.LoadUint64(&c.statistics.requestsRetried), 10) + "\n"))
+		writer.Write([]byte("requests_shed " + strconv.FormatUint(atomic.LoadUint64(&c.statistics.requestsShed), 10) + "\n"))
+		if c.config.ShadowUrl != "" {
+			writer.Write([]byte("shadow_requests " + strconv.FormatUint(atomic.LoadUint64(&c.shadowStats.requests), 10) + "\n"))
+			writer.Write([]byte("shadow_matches " + strconv.FormatUint(atomic.LoadUint64(&c.shadowStats.matches), 10) + "\n"))
+			writer.Write([]byte("shadow_mismatches " + strconv.FormatUint(atomic.LoadUint64(&c.shadowStats.mismatches), 10) + "\n"))
+			writer.Write([]byte("shadow_errors " + strconv.FormatUint(atomic.LoadUint64(&c.shadowStats.errors), 10) + "\n"))
+			writer.Write([]byte("shadow_dropped " + strconv.FormatUint(atomic.LoadUint64(&c.shadowStats.dropped), 10) + "\n"))
+			writer.Write([]byte("shadow_latency_diff_ms_sum " + strconv.FormatInt(atomic.LoadInt64(&c.shadowStats.latencyDiff), 10) + "\n"))
+		}
+		for _, upstream := range c.upstreams() {
+			available := 0
+			if upstream.available(time.Now()) {
+				available = 1
+			}
+			writer.Write([]byte("upstream_available{url=\"" + upstream.url + "\"} " + strconv.Itoa(available) + "\n"))
+			writer.Write([]byte("upstream_inflight{url=\"" + upstream.url + "\"} " + strconv.FormatInt(upstream.inflight.Load(), 10) + "\n"))
+		}
+		for _, r := range c.routes {
+			for _, variant := range r.variants {
+				labels := "{route=\"" + r.name + "\",variant=\"" + variant.name + "\"} "
+				writer.Write([]byte("variant_requests_succeeded" + labels + strconv.FormatUint(variant.pool.succeeded.Load(), 10) + "\n"))
+				writer.Write([]byte("variant_requests_failed" + labels + strconv.FormatUint(variant.pool.failed.Load(), 10) + "\n"))
+				writer.Write([]byte("circuit_breaker_state" + labels + strconv.Itoa(variant.pool.breaker.getState()) + "\n"))
+			}
+		}
 		if *memprofile != "" {
 			f, err := os.Create(*memprofile)
 			if err != nil {
@@ -189,18 +456,105 @@ func (c *Handler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
 			pprof.WriteHeapProfile(f)
 			f.Close()
 		}
+		return true
+	}
+	if address == "metrics" && request.Header.Get("Upgrade") != "websocket" {
+		if !c.authorize(writer, request, scopeReadStats) {
+			return true
+		}
+		c.serveMetrics(writer, request)
+		return true
+	}
+	if address == "connections" && request.Header.Get("Upgrade") != "websocket" {
+		if !c.authorize(writer, request, scopeReadStats) {
+			return true
+		}
+		c.serveConnections(writer, request)
+		return true
+	}
+	if address == "routes" && request.Header.Get("Upgrade") != "websocket" {
+		scope := scopeReadStats
+		if request.Method != http.MethodGet {
+			scope = scopeManage
+		}
+		if !c.authorize(writer, request, scope) {
+			return true
+		}
+		c.serveRoutes(writer, request)
+		return true
+	}
+	return false
+}
+
+// reservedClientIds are the names of the API endpoints, they can not be used
+// as the ClientId of a connection
+var reservedClientIds = map[string]bool{
+	"groups":      true, // groups managed by the API server
+	"batch":       true, // batch push
+	"broadcast":   true, // broadcast push
+	"metrics":     true, // Prometheus metrics
+	"connections": true, // connection registry
+	"routes":      true, // route variant weights
+}
+
+// serveConnect asks the API server whether the client may connect and upgrades the connection
+func (c *Handler) serveConnect(writer http.ResponseWriter, request *http.Request) {
+	route, vars := c.matchRoute(request)
+	if route == nil {
+		writer.WriteHeader(404)
+		writer.Write([]byte("not found"))
+		log.Printf("MethodGet: no route: %s", request.URL.Path)
+		return
+	}
+	address := expandTemplate(route.clientId, vars)
+	if reservedClientIds[address] {
+		writer.WriteHeader(400)
+		writer.Write([]byte("reserved client id"))
+		log.Printf("MethodGet: reserved client id: %s", address)
+		return
+	}
+	client := c.newClient(address, request)
+	client.variant = route.pickVariant(address)
+	client.vars = vars
+	if err := c.checkClientUrls(client); err != nil {
+		writer.WriteHeader(400)
+		writer.Write([]byte("bad request"))
+		log.Printf("MethodGet: %s", err.Error())
+		return
+	}
+	header := client.header.Clone()
+	if offered := request.Header.Get("Sec-WebSocket-Protocol"); offered != "" {
+		header.Set("Sec-WebSocket-Protocol", offered)
+	}
+	if _, exists := c.connections.Load(address); exists {
+		header.Set("X-Duplicate-Policy", c.config.DuplicatePolicy)
+	}
+	responseBytes, responseHeader, err := c.fetchDataRetry(client, true, "GET", "", header)
+	if err == errCircuitOpen {
+		writer.WriteHeader(503)
+		writer.Write([]byte("service unavailable"))
+		log.Printf("MethodGet: %s", err.Error())
 		return
 	}
-	responseBytes, err := c.fetchData(c.client, "GET", c.serverUrl+address, "")
 	if err != nil {
 		writer.WriteHeader(502)
 		writer.Write([]byte("bad gateway"))
 		log.Printf("MethodGet: %s", err.Error())
 		return
 	}
-	if responseBytes != "ok" {
-		writer.WriteHeader(403)
-		writer.Write([]byte("forbidden"))
+	decision, err := c.parseConnectDecision(responseBytes)
+	if err != nil {
+		writer.WriteHeader(502)
+		writer.Write([]byte("bad gateway"))
+		log.Printf("MethodGet: %s", err.Error())
+		return
+	}
+	if !decision.Accept {
+		for key, values := range decision.header() {
+			writer.Header()[key] = values
+		}
+		writer.WriteHeader(decision.Status)
+		writer.Write([]byte(decision.Body))
 		log.Println("MethodGet: not allowed to connect")
 		return
 	}
@@ -210,28 +564,151 @@ func (c *Handler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
 		log.Println("MethodGet: no upgrade requested")
 		return
 	}
-	connection, err := c.upgrader.Upgrade(writer, request)
+	if decision.Subprotocol == "" {
+		decision.Subprotocol = responseHeader.Get("Sec-WebSocket-Protocol")
+	}
+	subprotocol, ok := selectSubprotocol(request, decision.Subprotocol)
+	if !ok {
+		writer.WriteHeader(502)
+		writer.Write([]byte("bad gateway"))
+		log.Printf("MethodGet: subprotocol not offered: %s", decision.Subprotocol)
+		return
+	}
+	if _, exists := c.connections.Load(address); exists && c.config.DuplicatePolicy == "reject" {
+		writer.WriteHeader(409)
+		writer.Write([]byte("conflict"))
+		log.Printf("MethodGet: duplicate connection: %s", address)
+		return
+	}
+	client.session = decision.sessionHeader()
+	connection, err := c.getUpgrader(subprotocol, decision.header()).Upgrade(writer, request)
 	if err != nil {
 		log.Println("MethodGet: could not upgrade connection")
 		return
 	}
+	client.connect(connection)
+	// pushes wait until the queued messages are written
+	client.flushMutex.Lock()
+	if !c.register(client) {
+		client.flushMutex.Unlock()
+		client.closedBy("proxy", "duplicate connection")
+		connection.WriteClose(uint16(c.config.DuplicateCloseCode), []byte("duplicate connection"))
+		log.Printf("MethodGet: duplicate connection: %s", address)
+		// the read loop does not run, so OnClose is not called
+		c.notifyClose(client, "duplicate connection")
+		return
+	}
 	atomic.AddUint64(&conns, 1)
 	atomic.AddUint64(&c.statistics.connectionsOpened, 1)
-	c.connections.Store(address, connection)
-	c.addresses.Store(connection, address)
+	c.addresses.Store(connection, client)
+	c.updateGroups(client, responseHeader)
+	c.writeQueue(client)
+	client.flushMutex.Unlock()
 	connection.ReadLoop()
-	c.connections.Delete(address)
+	c.unregister(client)
+	c.requeueUnconfirmed(client)
+	c.leaveGroups(client)
 	c.addresses.Delete(connection)
 	atomic.AddUint64(&c.statistics.connectionsClosed, 1)
 }
 
+// pushAndWait sends a CALL to the client and responds with the client's
+// CALLRESULT or CALLERROR, or with a 504 when the wait time expires
+func (c *Handler) pushAndWait(writer http.ResponseWriter, request *http.Request, client *Client, message string) {
+	timeout, err := time.ParseDuration(request.URL.Query().Get("wait"))
+	if err != nil || timeout <= 0 || timeout > c.config.MaxPushWait {
+		writer.WriteHeader(400)
+		writer.Write([]byte("invalid wait"))
+		log.Printf("MethodPost: invalid wait: %s", request.URL.Query().Get("wait"))
+		return
+	}
+	messageType, messageId, ok := parseMessageId(message)
+	if !ok || messageType != ocppCall {
+		writer.WriteHeader(400)
+		writer.Write([]byte("wait requires a call"))
+		log.Println("MethodPost: wait requires a call")
+		return
+	}
+	reply, ok := c.waitForReply(client.address, messageId)
+	if !ok {
+		writer.WriteHeader(409)
+		writer.Write([]byte("already waiting"))
+		log.Printf("MethodPost: already waiting for message: %s", messageId)
+		return
+	}
+	defer c.stopWaiting(client.address, messageId, reply)
+	client.flushMutex.Lock()
+	c.writeQueue(client)
+	err = client.writeMessage(gws.OpcodeText, []byte(message))
+	client.flushMutex.Unlock()
+	if err != nil {
+		c.metrics.pushResult(resultWriteFailed)
+		writer.WriteHeader(502)
+		writer.Write([]byte("bad gateway"))
+		log.Println("MethodPost: could not write message")
+		return
+	}
+	c.metrics.pushResult(resultDelivered)
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case response := <-reply:
+		writer.Write([]byte(response))
+	case <-timer.C:
+		writer.WriteHeader(504)
+		writer.Write([]byte("gateway timeout"))
+		log.Printf("MethodPost: no reply for message: %s", messageId)
+	case <-request.Context().Done():
+	}
+}
+
+// disconnect closes the connection of a client with the close code from the
+// "code" parameter (default: 1000) and the request body as reason
+func (c *Handler) disconnect(writer http.ResponseWriter, request *http.Request, address string) {
+	client, ok := c.connections.Load(address)
+	if !ok {
+		writer.WriteHeader(404)
+		writer.Write([]byte("not found"))
+		log.Printf("MethodDelete: could not find connection: %s", address)
+		return
+	}
+	code := 1000
+	if request.URL.Query().Has("code") {
+		var err error
+		code, err = strconv.Atoi(request.URL.Query().Get("code"))
+		if err != nil || !validCloseCode(code) {
+			writer.WriteHeader(400)
+			writer.Write([]byte("invalid code"))
+			log.Printf("MethodDelete: invalid code: %s", request.URL.Query().Get("code"))
+			return
+		}
+	}
+	defer request.Body.Close()
+	bodyBytes, err := io.ReadAll(request.Body)
+	if err != nil {
+		writer.WriteHeader(500)
+		writer.Write([]byte("internal server error"))
+		log.Println("MethodDelete: could not read body")
+		return
+	}
+	client.closedBy("server", string(bodyBytes))
+	err = client.connection.WriteClose(uint16(code), bodyBytes)
+	if err != nil {
+		log.Printf("MethodDelete: %s", err.Error())
+	}
+	writer.Write([]byte("ok"))
+}
+
+// validCloseCode tells whether a close code may be sent in a close frame,
+// the reserved codes (1004-1006 and 1015) and the unassigned codes
+// (1016-2999) may not
+func validCloseCode(code int) bool {
+	return (code >= 1000 && code <= 1003) || (code >= 1007 && code <= 1014) || (code >= 3000 && code <= 4999)
+}
+
 func (c *Handler) OnMessage(connection *gws.Conn, message *gws.Message) {
 	defer message.Close()
 	atomic.AddUint64(&rps, 1)
-	if message.Opcode == gws.OpcodeBinary {
-		log.Println("OnMessage: binary messages not supported")
-		return
-	}
 	if message.Opcode == gws.OpcodePing {
 		err := connection.WritePong(message.Bytes())
 		if err != nil {
@@ -239,40 +716,116 @@ func (c *Handler) OnMessage(connection *gws.Conn, message *gws.Message) {
 		}
 		return
 	}
-	if message.Opcode == gws.OpcodeText {
+	if message.Opcode == gws.OpcodeText || message.Opcode == gws.OpcodeBinary {
 		msg := message.Data.String()
-		address, ok := c.addresses.Load(connection)
+		client, ok := c.addresses.Load(connection)
 		if !ok {
 			log.Println("OnMessage: could not find address")
 			return
 		}
-		err := error(nil)
-		responseBytes, err := c.fetchData(c.client, "POST", c.serverUrl+address, msg)
-		if err != nil {
-			log.Println(err.Error())
+		client.received()
+		c.metrics.message(directionIn, message.Opcode)
+		if c.config.Ordered {
+			// blocks the read loop when too many messages are queued
+			client.pending <- struct{}{}
+			connection.Async(func() {
+				c.handleMessage(client, message.Opcode, msg)
+				<-client.pending
+			})
+			return
+		}
+		c.handleMessage(client, message.Opcode, msg)
+		return
+	}
+}
+
+// handleMessage sends a message of the client to the API server and the response back to the client
+func (c *Handler) handleMessage(client *Client, opcode gws.Opcode, msg string) {
+	header := c.connectionHeader(client)
+	if opcode == gws.OpcodeBinary {
+		header.Set("Content-Type", "application/octet-stream")
+	} else {
+		header.Set("Content-Type", "text/plain; charset=utf-8")
+		c.acknowledgeReply(client.address, msg)
+		c.confirmReply(client.address, msg)
+		if c.deliverReply(client.address, msg) {
+			return
 		}
-		err = connection.WriteString(responseBytes)
+	}
+	if c.config.Protocol == "ocpp" && opcode == gws.OpcodeText {
+		ocppMsg, err := parseOcppMessage(msg)
 		if err != nil {
-			log.Println(err.Error())
+			log.Printf("OnMessage: %s", err.Error())
+			ocppErr := err.(*ocppError)
+			errorCode := ocppErrorCode(client.connection.SubProtocol(), ocppErr.errorCode)
+			err = client.writeMessage(gws.OpcodeText, []byte(ocppCallErrorMessage(ocppErr.messageId, errorCode, ocppErr.description)))
+			if err != nil {
+				log.Println(err.Error())
+			}
+			return
+		}
+		for key, values := range ocppMsg.header() {
+			header[key] = values
 		}
+	}
+	clientUrl, upstream := c.clientUrl(client, false)
+	responseBytes, responseHeader, err := c.fetchData(c.client, upstream, "POST", clientUrl, msg, header)
+	if err != nil {
+		log.Println(err.Error())
+		if c.config.Protocol == "ocpp" && opcode == gws.OpcodeText {
+			c.replyInternalError(client, msg)
+		}
+		return
+	}
+	c.updateGroups(client, responseHeader)
+	if responseBytes == "" {
 		return
 	}
+	err = client.writeMessage(c.messageOpcode(responseHeader.Get("Content-Type")), []byte(responseBytes))
+	if err != nil {
+		log.Println(err.Error())
+	}
+}
+
+// messageOpcode returns the websocket opcode for the content type of a message
+func (c *Handler) messageOpcode(contentType string) gws.Opcode {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	for _, binaryType := range c.config.BinaryContentTypes {
+		if strings.EqualFold(mediaType, binaryType) {
+			return gws.OpcodeBinary
+		}
+	}
+	return gws.OpcodeText
 }
 
 func (c *Handler) OnClose(connection *gws.Conn, err error) {
-	address, ok := c.addresses.Load(connection)
+	client, ok := c.addresses.Load(connection)
 	if !ok {
 		log.Printf("OnClose: could not find address")
 		return
 	}
 	reason := err.Error()
-	log.Printf("OnClose: address=%s error=%s", address, reason)
+	log.Printf("OnClose: address=%s error=%s", client.address, reason)
 	// this should be rate limited
 	closeErr, ok := err.(*gws.CloseError)
 	if ok {
 		reason = string(closeErr.Reason)
 	}
-	responseBytes, err := c.fetchData(c.client, "DELETE", c.serverUrl+address, reason)
+	// pushes go to the kept connection before the API server hears of the close
+	c.unregister(client)
+	c.notifyClose(client, reason)
+}
+
+// notifyClose sends the close of a connection to the API server, with the
+// initiator and reason of the proxy or the server when they closed it
+func (c *Handler) notifyClose(client *Client, reason string) {
+	header := c.connectionHeader(client)
+	header.Set("X-Close-Initiator", "client")
+	if closed := client.closed.Load(); closed != nil {
+		header.Set("X-Close-Initiator", closed.initiator)
+		reason = closed.reason
+	}
+	responseBytes, _, err := c.fetchDataRetry(client, false, "DELETE", reason, header)
 	if err != nil {
 		log.Println(err.Error())
 	}
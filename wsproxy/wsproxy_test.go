@@ -1,13 +1,18 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"sort"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/lxzan/gws"
 )
@@ -137,6 +142,32 @@ func TestConnectRejected(t *testing.T) {
 	}
 }
 
+// TestConnectReserved connects with a websocket with the name of an API
+// endpoint as ClientId and checks that it is rejected without a request.
+func TestConnectReserved(t *testing.T) {
+	// start api server
+	apiServer, _, _ := startLockStepTestWebServer(t)
+	defer apiServer.Close()
+	// start ws server
+	wsServer := httptest.NewServer(getWsHandler(apiServer.URL + "/"))
+	defer wsServer.Close()
+	wsUrl := strings.Replace(wsServer.URL, "http://", "ws://", 1)
+	// connect to ws server
+	_, response, err := gws.NewClient(nil, &gws.ClientOption{Addr: wsUrl + "/broadcast"})
+	errorMessage := ""
+	if err != nil {
+		errorMessage = err.Error()
+	}
+	// read number of request sent
+	counter1 := getCounterValueFromStatisticsUrl(t, wsServer.URL, "requests_started")
+	// compare results
+	got := fmt.Sprintf("%d %d %s", counter1, response.StatusCode, errorMessage)
+	want := "0 400 handshake error"
+	if got != want {
+		t.Errorf("got %q, wanted %q", got, want)
+	}
+}
+
 // TestConnectFailed connects with a websocket and checks
 // that a 502 is returned when the server is not available.
 func TestConnectFailed(t *testing.T) {
@@ -316,3 +347,1708 @@ func TestDisconnectUnexpected(t *testing.T) {
 		t.Errorf("got %q, wanted %q", got, want)
 	}
 }
+
+// TestOutgoingMessageWait sends a CALL using the push API with a wait
+// parameter and checks that the client's reply is returned as response.
+func TestOutgoingMessageWait(t *testing.T) {
+	// start api server
+	apiServer, requests, responses := startLockStepTestWebServer(t)
+	defer apiServer.Close()
+	// start ws server
+	wsServer := httptest.NewServer(getWsHandler(apiServer.URL + "/"))
+	defer wsServer.Close()
+	wsUrl := strings.Replace(wsServer.URL, "http://", "ws://", 1)
+	// connect to ws server
+	responses <- "200 ok"
+	wsClient, _, err := gws.NewClient(nil, &gws.ClientOption{Addr: wsUrl + "/test"})
+	<-requests
+	if err != nil {
+		t.Fatalf("error connecting ws client: %s", err.Error())
+	}
+	// reply to the call from the ws client
+	go func() {
+		messageBytes := make([]byte, 1024) // 1k buffer
+		wsClient.NetConn().Read(messageBytes)
+		wsClient.WriteString("[3,\"abc\",{\"status\":\"Accepted\"}]")
+	}()
+	// make post request that waits for the reply
+	c := &http.Client{}
+	response, err := c.Post(wsServer.URL+"/test?wait=5s", "plain/text", strings.NewReader("[2,\"abc\",\"Reset\",{}]"))
+	if err != nil {
+		t.Fatalf("error posting message: %s", err.Error())
+	}
+	bodyBytes, _ := io.ReadAll(response.Body)
+	// make post request that times out
+	response2, err := c.Post(wsServer.URL+"/test?wait=10ms", "plain/text", strings.NewReader("[2,\"def\",\"Reset\",{}]"))
+	if err != nil {
+		t.Fatalf("error posting message: %s", err.Error())
+	}
+	// close ws connection
+	responses <- "200 ok"
+	err = wsClient.WriteClose(1000, []byte(""))
+	<-requests
+	if err != nil {
+		t.Errorf("error closing ws from client: %s", err.Error())
+	}
+	// read number of request sent
+	counter1 := getCounterValueFromStatisticsUrl(t, wsServer.URL, "requests_started")
+	// compare results
+	got := fmt.Sprintf("%d %d %s %d", counter1, response.StatusCode, string(bodyBytes), response2.StatusCode)
+	want := "2 200 [3,\"abc\",{\"status\":\"Accepted\"}] 504"
+	if got != want {
+		t.Errorf("got %q, wanted %q", got, want)
+	}
+}
+
+// TestIncomingMessageMalformed sends a malformed OCPP-J message and checks
+// that a CALLERROR is returned without contacting the API server.
+func TestIncomingMessageMalformed(t *testing.T) {
+	// start api server
+	apiServer, requests, responses := startLockStepTestWebServer(t)
+	defer apiServer.Close()
+	// start ws server
+	config := defaultConfig()
+	config.ServerUrl = apiServer.URL + "/"
+	config.Protocol = "ocpp"
+	wsServer := httptest.NewServer(newHandler(config))
+	defer wsServer.Close()
+	wsUrl := strings.Replace(wsServer.URL, "http://", "ws://", 1)
+	// connect to ws server
+	responses <- "200 ok"
+	wsClient, _, err := gws.NewClient(nil, &gws.ClientOption{Addr: wsUrl + "/test"})
+	<-requests
+	if err != nil {
+		t.Fatalf("error connecting ws client: %s", err.Error())
+	}
+	// send ws message
+	wsClient.WriteMessage(gws.OpcodeText, []byte("[2,\"123\",\"Heartbeat\"]"))
+	// receive ws message
+	messageBytes := make([]byte, 1024) // 1k buffer
+	messageLength, err := wsClient.NetConn().Read(messageBytes)
+	if err != nil {
+		t.Errorf("error reading from ws client: %s", err.Error())
+	}
+	// close ws connection
+	responses <- "200 ok"
+	err = wsClient.WriteClose(1000, []byte("done"))
+	<-requests
+	if err != nil {
+		t.Errorf("error closing ws from client: %s", err.Error())
+	}
+	// read number of request sent
+	counter1 := getCounterValueFromStatisticsUrl(t, wsServer.URL, "requests_started")
+	// compare results
+	got := fmt.Sprintf("%d %s", counter1, string(messageBytes[2:messageLength]))
+	want := "2 [4,\"123\",\"FormationViolation\",\"call must have 4 elements\",{}]"
+	if got != want {
+		t.Errorf("got %q, wanted %q", got, want)
+	}
+}
+
+// TestConnectSubprotocol connects with a websocket that offers subprotocols
+// and checks that the API server chooses the subprotocol that is used.
+func TestConnectSubprotocol(t *testing.T) {
+	// start api server that chooses the subprotocol
+	requests := make(chan string, 3)
+	apiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- r.Method + " " + r.Header.Get("Sec-WebSocket-Protocol")
+		if r.Method == http.MethodGet {
+			w.Header().Set("Sec-WebSocket-Protocol", "ocpp1.6")
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer apiServer.Close()
+	// start ws server
+	wsServer := httptest.NewServer(getWsHandler(apiServer.URL + "/"))
+	defer wsServer.Close()
+	wsUrl := strings.Replace(wsServer.URL, "http://", "ws://", 1)
+	// connect to ws server
+	requestHeader := http.Header{}
+	requestHeader.Set("Sec-WebSocket-Protocol", "ocpp2.0.1, ocpp1.6")
+	wsClient, response, err := gws.NewClient(nil, &gws.ClientOption{Addr: wsUrl + "/test", RequestHeader: requestHeader})
+	if err != nil {
+		t.Fatalf("error connecting ws client: %s", err.Error())
+	}
+	// send ws message
+	wsClient.WriteMessage(gws.OpcodeText, []byte("request_message"))
+	wsClient.NetConn().Read(make([]byte, 1024))
+	// close ws connection
+	wsClient.WriteClose(1000, []byte("done"))
+	// compare results
+	got := fmt.Sprintf("%s|%s|%s|%s", response.Header.Get("Sec-WebSocket-Protocol"), <-requests, <-requests, <-requests)
+	want := "ocpp1.6|GET ocpp2.0.1, ocpp1.6|POST ocpp1.6|DELETE ocpp1.6"
+	if got != want {
+		t.Errorf("got %q, wanted %q", got, want)
+	}
+}
+
+// TestConnectForwardMetadata connects with a websocket and checks that the
+// allowed handshake headers and query parameters reach the API server.
+func TestConnectForwardMetadata(t *testing.T) {
+	// start api server that records the forwarded metadata
+	requests := make(chan string, 2)
+	apiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- r.Method + " " + r.RequestURI + " " + r.Header.Get("Authorization") + " " + r.Header.Get("X-Real-IP") + " " + r.Header.Get("User-Agent")
+		w.Write([]byte("ok"))
+	}))
+	defer apiServer.Close()
+	// start ws server
+	config := defaultConfig()
+	config.ServerUrl = apiServer.URL + "/"
+	config.ForwardHeaders = stringList{"Authorization"}
+	config.ForwardQuery = stringList{"token"}
+	config.ForwardOnMessage = true
+	wsServer := httptest.NewServer(newHandler(config))
+	defer wsServer.Close()
+	wsUrl := strings.Replace(wsServer.URL, "http://", "ws://", 1)
+	// connect to ws server
+	requestHeader := http.Header{}
+	requestHeader.Set("Authorization", "Basic dGVzdDp0ZXN0")
+	requestHeader.Set("User-Agent", "charger")
+	wsClient, _, err := gws.NewClient(nil, &gws.ClientOption{Addr: wsUrl + "/test?token=abc&other=def", RequestHeader: requestHeader})
+	if err != nil {
+		t.Fatalf("error connecting ws client: %s", err.Error())
+	}
+	// close ws connection
+	wsClient.WriteClose(1000, []byte("done"))
+	// compare results
+	got := fmt.Sprintf("%s|%s", <-requests, <-requests)
+	want := "GET /test?token=abc Basic dGVzdDp0ZXN0 127.0.0.1 Go-http-client/1.1|DELETE /test?token=abc Basic dGVzdDp0ZXN0 127.0.0.1 Go-http-client/1.1"
+	if got != want {
+		t.Errorf("got %q, wanted %q", got, want)
+	}
+}
+
+// TestConnectDecision connects with websockets to an API server that
+// responds with JSON decisions and checks the status codes, headers and session.
+func TestConnectDecision(t *testing.T) {
+	// start api server that rejects "denied", refuses "refused" with a status
+	// that is not an error, accepts "invalid" with an attribute that is not
+	// a valid header and accepts others with a session
+	requests := make(chan string, 2)
+	apiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet && r.URL.Path == "/denied" {
+			w.Write([]byte(`{"accept":false,"status":401,"body":"bad credentials","headers":{"WWW-Authenticate":"Basic"}}`))
+			return
+		}
+		if r.Method == http.MethodGet && r.URL.Path == "/refused" {
+			w.Write([]byte(`{"accept":false,"status":200}`))
+			return
+		}
+		if r.Method == http.MethodGet && r.URL.Path == "/invalid" {
+			w.Write([]byte(`{"accept":true,"attributes":{"Tenant":"acme\r\nX-Admin: 1"}}`))
+			return
+		}
+		if r.Method == http.MethodGet {
+			w.Write([]byte(`{"accept":true,"headers":{"X-Server":"api","Connection":"close"},"session":"s3cr3t","attributes":{"Tenant":"acme"}}`))
+			return
+		}
+		requests <- r.Method + " " + r.Header.Get("X-Session") + " " + r.Header.Get("X-Session-Tenant")
+		w.Write([]byte("ok"))
+	}))
+	defer apiServer.Close()
+	// start ws server
+	config := defaultConfig()
+	config.ServerUrl = apiServer.URL + "/"
+	config.ConnectResponse = "json"
+	wsServer := httptest.NewServer(newHandler(config))
+	defer wsServer.Close()
+	wsUrl := strings.Replace(wsServer.URL, "http://", "ws://", 1)
+	// connect to ws server with rejection
+	_, response1, _ := gws.NewClient(nil, &gws.ClientOption{Addr: wsUrl + "/denied"})
+	_, response3, _ := gws.NewClient(nil, &gws.ClientOption{Addr: wsUrl + "/refused"})
+	_, response4, _ := gws.NewClient(nil, &gws.ClientOption{Addr: wsUrl + "/invalid"})
+	// connect to ws server with session
+	wsClient, response2, err := gws.NewClient(nil, &gws.ClientOption{Addr: wsUrl + "/test"})
+	if err != nil {
+		t.Fatalf("error connecting ws client: %s", err.Error())
+	}
+	// close ws connection
+	wsClient.WriteClose(1000, []byte("done"))
+	// compare results
+	got := fmt.Sprintf("%d %s %d %d %d %s %s %s", response1.StatusCode, response1.Header.Get("WWW-Authenticate"), response3.StatusCode, response4.StatusCode, response2.StatusCode, response2.Header.Get("X-Server"), response2.Header.Get("Connection"), <-requests)
+	want := "401 Basic 502 502 101 api Upgrade DELETE s3cr3t acme"
+	if got != want {
+		t.Errorf("got %q, wanted %q", got, want)
+	}
+}
+
+// TestBinaryMessages sends and receives binary messages in both
+// directions and checks that the bytes and framing are preserved.
+func TestBinaryMessages(t *testing.T) {
+	// start api server that echoes binary messages
+	requests := make(chan string, 1)
+	apiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bodyBytes, _ := io.ReadAll(r.Body)
+		if r.Method == http.MethodPost {
+			requests <- fmt.Sprintf("%s %q", r.Header.Get("Content-Type"), bodyBytes)
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Write(bodyBytes)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer apiServer.Close()
+	// start ws server
+	wsServer := httptest.NewServer(getWsHandler(apiServer.URL + "/"))
+	defer wsServer.Close()
+	wsUrl := strings.Replace(wsServer.URL, "http://", "ws://", 1)
+	// connect to ws server
+	wsClient, _, err := gws.NewClient(nil, &gws.ClientOption{Addr: wsUrl + "/test"})
+	if err != nil {
+		t.Fatalf("error connecting ws client: %s", err.Error())
+	}
+	// send binary ws message
+	wsClient.WriteMessage(gws.OpcodeBinary, []byte{0x00, 0xa1, 0xff})
+	request := <-requests
+	messageBytes := make([]byte, 1024) // 1k buffer
+	messageLength, _ := wsClient.NetConn().Read(messageBytes)
+	response := string(messageBytes[:messageLength])
+	// make binary post request
+	c := &http.Client{}
+	c.Post(wsServer.URL+"/test", "application/octet-stream", strings.NewReader("\x00\xfe"))
+	messageLength, _ = wsClient.NetConn().Read(messageBytes)
+	pushed := string(messageBytes[:messageLength])
+	// close ws connection
+	wsClient.WriteClose(1000, []byte("done"))
+	// compare results
+	got := fmt.Sprintf("%s %q %q", request, response, pushed)
+	want := `application/octet-stream "\x00\xa1\xff" "\x82\x03\x00\xa1\xff" "\x82\x02\x00\xfe"` // \x82 = binary message
+	if got != want {
+		t.Errorf("got %q, wanted %q", got, want)
+	}
+}
+
+// TestOrderedMessages sends two messages of which the first is slow to handle
+// and checks that in ordered mode they reach the API server one by one and
+// that the responses are sent in request order.
+func TestOrderedMessages(t *testing.T) {
+	// start api server that echoes messages and is slow on the first message
+	inFlight, maxInFlight := int32(0), int32(0)
+	apiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bodyBytes, _ := io.ReadAll(r.Body)
+		if r.Method == http.MethodPost {
+			n := atomic.AddInt32(&inFlight, 1)
+			if n > atomic.LoadInt32(&maxInFlight) {
+				atomic.StoreInt32(&maxInFlight, n)
+			}
+			if string(bodyBytes) == "1" {
+				time.Sleep(100 * time.Millisecond)
+			}
+			atomic.AddInt32(&inFlight, -1)
+			w.Write(bodyBytes)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer apiServer.Close()
+	// start ws server
+	config := defaultConfig()
+	config.ServerUrl = apiServer.URL + "/"
+	config.Ordered = true
+	wsServer := httptest.NewServer(newHandler(config))
+	defer wsServer.Close()
+	wsUrl := strings.Replace(wsServer.URL, "http://", "ws://", 1)
+	// connect to ws server
+	wsClient, _, err := gws.NewClient(nil, &gws.ClientOption{Addr: wsUrl + "/test"})
+	if err != nil {
+		t.Fatalf("error connecting ws client: %s", err.Error())
+	}
+	// send two ws messages and receive both responses
+	wsClient.WriteMessage(gws.OpcodeText, []byte("1"))
+	wsClient.WriteMessage(gws.OpcodeText, []byte("2"))
+	messageBytes := make([]byte, 6)
+	_, err = io.ReadFull(wsClient.NetConn(), messageBytes)
+	if err != nil {
+		t.Errorf("error reading from ws client: %s", err.Error())
+	}
+	// close ws connection
+	wsClient.WriteClose(1000, []byte("done"))
+	// compare results
+	got := fmt.Sprintf("%d %q", atomic.LoadInt32(&maxInFlight), messageBytes)
+	want := `1 "\x81\x011\x81\x012"`
+	if got != want {
+		t.Errorf("got %q, wanted %q", got, want)
+	}
+}
+
+// TestDuplicateConnection connects twice with the same ClientId and checks
+// the "takeover" and "reject" duplicate policies.
+func TestDuplicateConnection(t *testing.T) {
+	for _, policy := range []string{"takeover", "reject"} {
+		// start api server that records the duplicate policy header
+		requests := make(chan string, 4)
+		apiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests <- r.Method + " " + r.Header.Get("X-Duplicate-Policy")
+			w.Write([]byte("ok"))
+		}))
+		// start ws server
+		config := defaultConfig()
+		config.ServerUrl = apiServer.URL + "/"
+		config.DuplicatePolicy = policy
+		wsServer := httptest.NewServer(newHandler(config))
+		wsUrl := strings.Replace(wsServer.URL, "http://", "ws://", 1)
+		// connect to ws server twice
+		wsClient1, _, err := gws.NewClient(nil, &gws.ClientOption{Addr: wsUrl + "/test"})
+		if err != nil {
+			t.Fatalf("error connecting ws client: %s", err.Error())
+		}
+		wsClient2, response2, _ := gws.NewClient(nil, &gws.ClientOption{Addr: wsUrl + "/test"})
+		// read the close frame of the first connection in case of a takeover
+		closeFrame := ""
+		if policy == "takeover" {
+			messageBytes := make([]byte, 1024) // 1k buffer
+			messageLength, _ := wsClient1.NetConn().Read(messageBytes)
+			closeFrame = string(messageBytes[:messageLength])
+			// the delete of the replaced connection may not unregister the new connection
+			<-requests
+			<-requests
+			<-requests
+		}
+		// make post request to the registered connection
+		c := &http.Client{}
+		response, err := c.Post(wsServer.URL+"/test", "plain/text", strings.NewReader("server_message"))
+		if err != nil {
+			t.Fatalf("error posting message: %s", err.Error())
+		}
+		got := fmt.Sprintf("%d %d %q", response2.StatusCode, response.StatusCode, closeFrame)
+		want := map[string]string{
+			"takeover": "101 200 \"\\x88\\x15\\x0f\\xa0connection replaced\"",
+			"reject":   "409 200 \"\"",
+		}[policy]
+		if policy == "reject" {
+			<-requests
+			got += " " + <-requests
+			want += " GET reject"
+			wsClient1.WriteClose(1000, []byte("done"))
+		} else {
+			wsClient2.WriteClose(1000, []byte("done"))
+		}
+		if got != want {
+			t.Errorf("got %q, wanted %q", got, want)
+		}
+		wsServer.Close()
+		apiServer.Close()
+	}
+}
+
+// TestDuplicateConnectionKeep connects twice with the duplicate policy
+// "keep", closes the newer connection first and checks that messages are
+// pushed to the older connection again.
+func TestDuplicateConnectionKeep(t *testing.T) {
+	// start api server
+	requests := make(chan string, 4)
+	apiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- r.Method + " " + r.URL.Path
+		w.Write([]byte("ok"))
+	}))
+	defer apiServer.Close()
+	// start ws server
+	config := defaultConfig()
+	config.ServerUrl = apiServer.URL + "/"
+	config.DuplicatePolicy = "keep"
+	wsServer := httptest.NewServer(newHandler(config))
+	defer wsServer.Close()
+	wsUrl := strings.Replace(wsServer.URL, "http://", "ws://", 1)
+	// connect to ws server twice
+	collector := &messageCollector{messages: make(chan string, 10)}
+	wsClient1, _, err := gws.NewClient(collector, &gws.ClientOption{Addr: wsUrl + "/a1"})
+	if err != nil {
+		t.Fatalf("error connecting ws client: %s", err.Error())
+	}
+	defer wsClient1.WriteClose(1000, []byte("done"))
+	go wsClient1.ReadLoop()
+	wsClient2, _, err := gws.NewClient(nil, &gws.ClientOption{Addr: wsUrl + "/a1"})
+	if err != nil {
+		t.Fatalf("error connecting ws client: %s", err.Error())
+	}
+	<-requests
+	<-requests
+	// both connections are open (they are counted after the upgrade)
+	active := int64(0)
+	for i := 0; i < 100 && active != 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+		active = getCounterValueFromStatisticsUrl(t, wsServer.URL+"/metrics", "wsproxy_connections_active")
+	}
+	// close the newer connection
+	wsClient2.WriteClose(1000, []byte("done"))
+	closed := <-requests
+	// make post request to the older connection, it is registered again
+	// before the close is sent to the API server
+	c := &http.Client{}
+	response, err := c.Post(wsServer.URL+"/a1", "plain/text", strings.NewReader("server_message"))
+	if err != nil {
+		t.Fatalf("error posting message: %s", err.Error())
+	}
+	received := ""
+	select {
+	case received = <-collector.messages:
+	case <-time.After(5 * time.Second):
+	}
+	// compare results
+	got := fmt.Sprintf("%d|%s|%d|%s", active, closed, response.StatusCode, received)
+	want := "2|DELETE /a1|200|server_message"
+	if got != want {
+		t.Errorf("got %q, wanted %q", got, want)
+	}
+}
+
+// TestDisconnectByServer disconnects a websocket using the push API and
+// checks the close frame and the notification of the API server.
+func TestDisconnectByServer(t *testing.T) {
+	// start api server that records the close initiator
+	requests := make(chan string, 2)
+	apiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bodyBytes, _ := io.ReadAll(r.Body)
+		requests <- strings.Trim(r.Method+" "+r.Header.Get("X-Close-Initiator")+" "+string(bodyBytes), " ")
+		w.Write([]byte("ok"))
+	}))
+	defer apiServer.Close()
+	// start ws server
+	wsServer := httptest.NewServer(getWsHandler(apiServer.URL + "/"))
+	defer wsServer.Close()
+	wsUrl := strings.Replace(wsServer.URL, "http://", "ws://", 1)
+	// connect to ws server
+	wsClient, _, err := gws.NewClient(nil, &gws.ClientOption{Addr: wsUrl + "/test"})
+	<-requests
+	if err != nil {
+		t.Fatalf("error connecting ws client: %s", err.Error())
+	}
+	// make delete requests
+	c := &http.Client{}
+	request, _ := http.NewRequest(http.MethodDelete, wsServer.URL+"/unknown", nil)
+	response1, err := c.Do(request)
+	if err != nil {
+		t.Fatalf("error deleting connection: %s", err.Error())
+	}
+	request, _ = http.NewRequest(http.MethodDelete, wsServer.URL+"/test?code=1005", nil)
+	response3, err := c.Do(request)
+	if err != nil {
+		t.Fatalf("error deleting connection: %s", err.Error())
+	}
+	request, _ = http.NewRequest(http.MethodDelete, wsServer.URL+"/test?code=4001", strings.NewReader("revoked"))
+	response2, err := c.Do(request)
+	if err != nil {
+		t.Fatalf("error deleting connection: %s", err.Error())
+	}
+	// receive close frame
+	messageBytes := make([]byte, 1024) // 1k buffer
+	messageLength, _ := wsClient.NetConn().Read(messageBytes)
+	// compare results
+	got := fmt.Sprintf("%d %d %d %q %s", response1.StatusCode, response3.StatusCode, response2.StatusCode, messageBytes[:messageLength], <-requests)
+	want := "404 400 200 \"\\x88\\t\\x0f\\xa1revoked\" DELETE server revoked" // \x88 = close frame, \x0f\xa1 = 4001
+	if got != want {
+		t.Errorf("got %q, wanted %q", got, want)
+	}
+}
+
+// TestConnectionRegistry connects three websockets and checks the
+// listing (with prefix and pagination) and lookup of connections.
+func TestConnectionRegistry(t *testing.T) {
+	// start api server
+	apiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer apiServer.Close()
+	// start ws server
+	wsServer := httptest.NewServer(getWsHandler(apiServer.URL + "/"))
+	defer wsServer.Close()
+	wsUrl := strings.Replace(wsServer.URL, "http://", "ws://", 1)
+	// connect to ws server
+	for _, clientId := range []string{"a2", "b1", "a1"} {
+		wsClient, _, err := gws.NewClient(nil, &gws.ClientOption{Addr: wsUrl + "/" + clientId})
+		if err != nil {
+			t.Fatalf("error connecting ws client: %s", err.Error())
+		}
+		defer wsClient.WriteClose(1000, []byte("done"))
+	}
+	// query the registry
+	get := func(path string) string {
+		response, err := http.Get(wsServer.URL + path)
+		if err != nil {
+			t.Fatalf("error querying registry: %s", err.Error())
+		}
+		bodyBytes, _ := io.ReadAll(response.Body)
+		return fmt.Sprintf("%d %s", response.StatusCode, strings.TrimSpace(string(bodyBytes)))
+	}
+	page1 := get("/connections?prefix=a&limit=1")
+	page2 := get("/connections?prefix=a&limit=1&after=a1")
+	info := get("/connections/b1")
+	missing := get("/connections/c1")
+	// compare results
+	got := fmt.Sprintf("%s|%s|%v|%s", page1, page2, strings.Contains(info, `"clientId":"b1","remoteAddr":"127.0.0.1:`), missing)
+	want := `200 {"count":2,"clientIds":["a1"],"next":"a1"}|200 {"count":2,"clientIds":["a2"]}|true|404 {}`
+	if got != want {
+		t.Errorf("got %q, wanted %q", got, want)
+	}
+}
+
+// TestBroadcast connects three websockets and pushes a message to a list of
+// clients and to the clients with a prefix.
+func TestBroadcast(t *testing.T) {
+	// start api server
+	apiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer apiServer.Close()
+	// start ws server
+	wsServer := httptest.NewServer(getWsHandler(apiServer.URL + "/"))
+	defer wsServer.Close()
+	wsUrl := strings.Replace(wsServer.URL, "http://", "ws://", 1)
+	// connect to ws server
+	wsClients := map[string]*gws.Conn{}
+	for _, clientId := range []string{"a1", "a2", "b1"} {
+		wsClient, _, err := gws.NewClient(nil, &gws.ClientOption{Addr: wsUrl + "/" + clientId})
+		if err != nil {
+			t.Fatalf("error connecting ws client: %s", err.Error())
+		}
+		defer wsClient.WriteClose(1000, []byte("done"))
+		wsClients[clientId] = wsClient
+	}
+	// push messages
+	post := func(query, message string) string {
+		response, err := http.Post(wsServer.URL+"/broadcast?"+query, "text/plain", strings.NewReader(message))
+		if err != nil {
+			t.Fatalf("error pushing message: %s", err.Error())
+		}
+		bodyBytes, _ := io.ReadAll(response.Body)
+		return fmt.Sprintf("%d %s", response.StatusCode, strings.TrimSpace(string(bodyBytes)))
+	}
+	list := post("clientId=b1&clientId=c1", "one")
+	prefix := post("prefix=a", "two")
+	invalid := post("", "three")
+	// read messages
+	received := []string{}
+	for _, clientId := range []string{"a1", "a2", "b1"} {
+		messageBytes := make([]byte, 1024)
+		n, err := wsClients[clientId].NetConn().Read(messageBytes)
+		if err != nil {
+			t.Fatalf("error reading message: %s", err.Error())
+		}
+		received = append(received, clientId+":"+string(messageBytes[2:n]))
+	}
+	// compare results
+	got := fmt.Sprintf("%s|%s|%s|%v", list, prefix, invalid, received)
+	want := `200 {"delivered":1,"notConnected":1,"failed":0,"results":{"b1":"delivered","c1":"not connected"}}|` +
+		`200 {"delivered":2,"notConnected":0,"failed":0,"results":{"a1":"delivered","a2":"delivered"}}|` +
+		`400 bad request|[a1:two a2:two b1:one]`
+	if got != want {
+		t.Errorf("got %q, wanted %q", got, want)
+	}
+}
+
+// TestGroups lets the API server add connections to a group on connect and
+// remove them on a message, uses the admin API and pushes to the group.
+func TestGroups(t *testing.T) {
+	// start api server
+	apiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" && strings.HasPrefix(r.URL.Path, "/s") {
+			w.Header().Set("X-Group-Join", "site1, all")
+		}
+		if r.Method == "POST" {
+			w.Header().Set("X-Group-Leave", "site1")
+			w.Write([]byte("left"))
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer apiServer.Close()
+	// start ws server
+	wsServer := httptest.NewServer(getWsHandler(apiServer.URL + "/"))
+	defer wsServer.Close()
+	wsUrl := strings.Replace(wsServer.URL, "http://", "ws://", 1)
+	// connect to ws server
+	wsClients := map[string]*gws.Conn{}
+	for _, clientId := range []string{"s1", "s2", "d1"} {
+		wsClient, _, err := gws.NewClient(nil, &gws.ClientOption{Addr: wsUrl + "/" + clientId})
+		if err != nil {
+			t.Fatalf("error connecting ws client: %s", err.Error())
+		}
+		defer wsClient.WriteClose(1000, []byte("done"))
+		wsClients[clientId] = wsClient
+	}
+	request := func(method, path, body string) string {
+		req, _ := http.NewRequest(method, wsServer.URL+path, strings.NewReader(body))
+		response, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("error sending request: %s", err.Error())
+		}
+		bodyBytes, _ := io.ReadAll(response.Body)
+		return fmt.Sprintf("%d %s", response.StatusCode, strings.TrimSpace(string(bodyBytes)))
+	}
+	read := func(clientId string) string {
+		messageBytes := make([]byte, 1024)
+		n, err := wsClients[clientId].NetConn().Read(messageBytes)
+		if err != nil {
+			t.Fatalf("error reading message: %s", err.Error())
+		}
+		return string(messageBytes[2:n])
+	}
+	// join and leave
+	joined := request("PUT", "/groups/site1/d1", "")
+	wsClients["s2"].WriteString("leave")
+	left := read("s2")
+	members := request("GET", "/groups/site1", "")
+	// close a member
+	wsClients["s1"].WriteClose(1000, []byte("done"))
+	closed := ""
+	for i := 0; i < 100; i++ {
+		closed = request("GET", "/groups/all", "")
+		if !strings.Contains(closed, "s1") {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// push to group
+	pushed := request("POST", "/groups/site1", "hello")
+	received := read("d1")
+	// compare results
+	got := fmt.Sprintf("%s|%s|%s|%s|%s|%s", joined, left, members, closed, pushed, received)
+	want := `200 ok|left|200 {"count":2,"clientIds":["d1","s1"]}|200 {"count":1,"clientIds":["s2"]}|` +
+		`200 {"delivered":1,"notConnected":0,"failed":0,"results":{"d1":"delivered"}}|hello`
+	if got != want {
+		t.Errorf("got %q, wanted %q", got, want)
+	}
+}
+
+// TestBatchPush pushes different messages to clients using a JSON array and
+// NDJSON and checks the streamed results.
+func TestBatchPush(t *testing.T) {
+	// start api server
+	apiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer apiServer.Close()
+	// start ws server
+	wsServer := httptest.NewServer(getWsHandler(apiServer.URL + "/"))
+	defer wsServer.Close()
+	wsUrl := strings.Replace(wsServer.URL, "http://", "ws://", 1)
+	// connect to ws server
+	wsClients := map[string]*gws.Conn{}
+	for _, clientId := range []string{"a1", "b1"} {
+		wsClient, _, err := gws.NewClient(nil, &gws.ClientOption{Addr: wsUrl + "/" + clientId})
+		if err != nil {
+			t.Fatalf("error connecting ws client: %s", err.Error())
+		}
+		defer wsClient.WriteClose(1000, []byte("done"))
+		wsClients[clientId] = wsClient
+	}
+	// push batches
+	post := func(body string) string {
+		response, err := http.Post(wsServer.URL+"/batch", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("error pushing batch: %s", err.Error())
+		}
+		bodyBytes, _ := io.ReadAll(response.Body)
+		lines := strings.Split(strings.TrimSpace(string(bodyBytes)), "\n")
+		sort.Strings(lines)
+		return strings.Join(lines, ",")
+	}
+	read := func(clientId string) string {
+		messageBytes := make([]byte, 1024)
+		n, err := wsClients[clientId].NetConn().Read(messageBytes)
+		if err != nil {
+			t.Fatalf("error reading message: %s", err.Error())
+		}
+		return fmt.Sprintf("%s:%d:%q", clientId, messageBytes[0]&0x0f, messageBytes[2:n])
+	}
+	array := post(`[{"clientId":"a1","message":"one"},{"clientId":"b1","message":"AAE=","binary":true},{"clientId":"c1","message":"three"}]`)
+	received := []string{read("a1"), read("b1")}
+	ndjson := post("{\"clientId\":\"a1\",\"message\":\"four\"}\n{\"message\":\"five\"}\n")
+	received = append(received, read("a1"))
+	// compare results
+	got := fmt.Sprintf("%s|%s|%v", array, ndjson, received)
+	want := `{"index":0,"clientId":"a1","result":"delivered"},{"index":1,"clientId":"b1","result":"delivered"},{"index":2,"clientId":"c1","result":"not connected"}|` +
+		`{"index":0,"clientId":"a1","result":"delivered"},{"index":1,"error":"invalid item"}|` +
+		`[a1:1:"one" b1:2:"\x00\x01" a1:1:"four"]`
+	if got != want {
+		t.Errorf("got %q, wanted %q", got, want)
+	}
+}
+
+// messageCollector is a websocket client event handler that collects the received messages
+type messageCollector struct {
+	gws.BuiltinEventHandler
+	messages chan string
+}
+
+func (c *messageCollector) OnMessage(socket *gws.Conn, message *gws.Message) {
+	defer message.Close()
+	c.messages <- message.Data.String()
+}
+
+// TestOfflineQueue pushes messages to a client that is not connected and
+// checks that they are sent in order after the client connects.
+func TestOfflineQueue(t *testing.T) {
+	// start api server
+	apiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer apiServer.Close()
+	// start ws server
+	config := defaultConfig()
+	config.ServerUrl = apiServer.URL + "/"
+	config.QueueTtl = time.Minute
+	config.QueueDepth = 2
+	wsServer := httptest.NewServer(newHandler(config))
+	defer wsServer.Close()
+	wsUrl := strings.Replace(wsServer.URL, "http://", "ws://", 1)
+	// push messages (a reserved ClientId is never queued)
+	results := []string{}
+	for _, push := range [][2]string{{"/q1", "one"}, {"/q1", "two"}, {"/q1", "three"}, {"/metrics", "four"}} {
+		response, err := http.Post(wsServer.URL+push[0], "text/plain", strings.NewReader(push[1]))
+		if err != nil {
+			t.Fatalf("error pushing message: %s", err.Error())
+		}
+		bodyBytes, _ := io.ReadAll(response.Body)
+		results = append(results, fmt.Sprintf("%d %s", response.StatusCode, bodyBytes))
+	}
+	// connect to ws server (the messages may arrive with the handshake)
+	collector := &messageCollector{messages: make(chan string, 10)}
+	wsClient, _, err := gws.NewClient(collector, &gws.ClientOption{Addr: wsUrl + "/q1"})
+	if err != nil {
+		t.Fatalf("error connecting ws client: %s", err.Error())
+	}
+	defer wsClient.WriteClose(1000, []byte("done"))
+	go wsClient.ReadLoop()
+	// read messages
+	received := []string{<-collector.messages, <-collector.messages}
+	// compare results
+	got := fmt.Sprintf("%v|%v", results, received)
+	want := `[200 queued 200 queued 503 queue full 404 not found]|[one two]`
+	if got != want {
+		t.Errorf("got %q, wanted %q", got, want)
+	}
+}
+
+// TestOfflineQueueOrder queues a message for a client that is connected
+// (as when it connects while the message is queued) and checks that a
+// pushed message is written after the queued message.
+func TestOfflineQueueOrder(t *testing.T) {
+	// start api server
+	apiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer apiServer.Close()
+	// start ws server
+	config := defaultConfig()
+	config.ServerUrl = apiServer.URL + "/"
+	config.QueueTtl = time.Minute
+	handler := newHandler(config)
+	wsServer := httptest.NewServer(handler)
+	defer wsServer.Close()
+	wsUrl := strings.Replace(wsServer.URL, "http://", "ws://", 1)
+	// connect to ws server
+	collector := &messageCollector{messages: make(chan string, 10)}
+	wsClient, _, err := gws.NewClient(collector, &gws.ClientOption{Addr: wsUrl + "/q1"})
+	if err != nil {
+		t.Fatalf("error connecting ws client: %s", err.Error())
+	}
+	defer wsClient.WriteClose(1000, []byte("done"))
+	go wsClient.ReadLoop()
+	// queue a message and push a message
+	handler.queues.Store("q1", []queuedMessage{{0, gws.OpcodeText, []byte("one"), time.Now().Add(time.Minute)}})
+	response, err := http.Post(wsServer.URL+"/q1", "text/plain", strings.NewReader("two"))
+	if err != nil {
+		t.Fatalf("error pushing message: %s", err.Error())
+	}
+	// compare results
+	got := fmt.Sprintf("%d %v", response.StatusCode, []string{<-collector.messages, <-collector.messages})
+	want := "200 [one two]"
+	if got != want {
+		t.Errorf("got %q, wanted %q", got, want)
+	}
+}
+
+// TestDurableQueue queues messages in a queue directory, restarts the proxy
+// and checks that the messages are sent after the client connects.
+func TestDurableQueue(t *testing.T) {
+	// start api server
+	apiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer apiServer.Close()
+	// start ws server and push messages
+	config := defaultConfig()
+	config.ServerUrl = apiServer.URL + "/"
+	config.QueueTtl = time.Minute
+	config.QueueDir = t.TempDir()
+	handler := newHandler(config)
+	if err := handler.openQueue(); err != nil {
+		t.Fatalf("error opening queue: %s", err.Error())
+	}
+	wsServer := httptest.NewServer(handler)
+	for _, message := range []string{"one", "two"} {
+		_, err := http.Post(wsServer.URL+"/q1", "text/plain", strings.NewReader(message))
+		if err != nil {
+			t.Fatalf("error pushing message: %s", err.Error())
+		}
+	}
+	wsServer.Close()
+	handler.store.close()
+	// restart ws server
+	handler = newHandler(config)
+	if err := handler.openQueue(); err != nil {
+		t.Fatalf("error opening queue: %s", err.Error())
+	}
+	wsServer = httptest.NewServer(handler)
+	defer wsServer.Close()
+	wsUrl := strings.Replace(wsServer.URL, "http://", "ws://", 1)
+	// connect to ws server
+	collector := &messageCollector{messages: make(chan string, 10)}
+	wsClient, _, err := gws.NewClient(collector, &gws.ClientOption{Addr: wsUrl + "/q1"})
+	if err != nil {
+		t.Fatalf("error connecting ws client: %s", err.Error())
+	}
+	defer wsClient.WriteClose(1000, []byte("done"))
+	go wsClient.ReadLoop()
+	received := []string{<-collector.messages, <-collector.messages}
+	// the delivered messages are acknowledged in the store
+	segment := handler.store.segment("q1")
+	for i := 0; i < 100; i++ {
+		segment.mutex.Lock()
+		live := segment.live
+		segment.mutex.Unlock()
+		if live == 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	handler.store.close()
+	_, queues, err := openQueueStore(config.QueueDir, config.QueueFsync)
+	if err != nil {
+		t.Fatalf("error opening queue store: %s", err.Error())
+	}
+	// compare results
+	got := fmt.Sprintf("%v %d", received, len(queues))
+	want := "[one two] 0"
+	if got != want {
+		t.Errorf("got %q, wanted %q", got, want)
+	}
+}
+
+// TestDurableQueueCall queues a CALL in a queue directory and checks that it
+// is only acknowledged in the store after the client replies to it.
+func TestDurableQueueCall(t *testing.T) {
+	// start api server
+	apiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer apiServer.Close()
+	// start ws server and push a call
+	config := defaultConfig()
+	config.ServerUrl = apiServer.URL + "/"
+	config.QueueTtl = time.Minute
+	config.QueueDir = t.TempDir()
+	handler := newHandler(config)
+	if err := handler.openQueue(); err != nil {
+		t.Fatalf("error opening queue: %s", err.Error())
+	}
+	defer handler.store.close()
+	wsServer := httptest.NewServer(handler)
+	defer wsServer.Close()
+	wsUrl := strings.Replace(wsServer.URL, "http://", "ws://", 1)
+	_, err := http.Post(wsServer.URL+"/q1", "text/plain", strings.NewReader(`[2,"m1","Reset",{}]`))
+	if err != nil {
+		t.Fatalf("error pushing message: %s", err.Error())
+	}
+	// connect to ws server
+	collector := &messageCollector{messages: make(chan string, 10)}
+	wsClient, _, err := gws.NewClient(collector, &gws.ClientOption{Addr: wsUrl + "/q1"})
+	if err != nil {
+		t.Fatalf("error connecting ws client: %s", err.Error())
+	}
+	defer wsClient.WriteClose(1000, []byte("done"))
+	go wsClient.ReadLoop()
+	received := <-collector.messages
+	segment := handler.store.segment("q1")
+	live := func(want int) int {
+		for i := 0; i < 100; i++ {
+			segment.mutex.Lock()
+			live := segment.live
+			segment.mutex.Unlock()
+			if live == want {
+				return live
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		segment.mutex.Lock()
+		defer segment.mutex.Unlock()
+		return segment.live
+	}
+	before := live(1)
+	// reply to the call
+	wsClient.WriteString(`[3,"m1",{"status":"Accepted"}]`)
+	after := live(0)
+	// compare results
+	got := fmt.Sprintf("%s %d %d", received, before, after)
+	want := `[2,"m1","Reset",{}] 1 0`
+	if got != want {
+		t.Errorf("got %q, wanted %q", got, want)
+	}
+}
+
+// TestDurableQueueCallReconnect queues a CALL in a queue directory, closes
+// the connection without a reply and checks that the CALL is sent again when
+// the client reconnects.
+func TestDurableQueueCallReconnect(t *testing.T) {
+	// start api server
+	apiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer apiServer.Close()
+	// start ws server and push a call
+	config := defaultConfig()
+	config.ServerUrl = apiServer.URL + "/"
+	config.QueueTtl = time.Minute
+	config.QueueDir = t.TempDir()
+	handler := newHandler(config)
+	if err := handler.openQueue(); err != nil {
+		t.Fatalf("error opening queue: %s", err.Error())
+	}
+	defer handler.store.close()
+	wsServer := httptest.NewServer(handler)
+	defer wsServer.Close()
+	wsUrl := strings.Replace(wsServer.URL, "http://", "ws://", 1)
+	_, err := http.Post(wsServer.URL+"/q1", "text/plain", strings.NewReader(`[2,"m1","Reset",{}]`))
+	if err != nil {
+		t.Fatalf("error pushing message: %s", err.Error())
+	}
+	// connect to ws server and close without a reply
+	received := []string{}
+	for i := 0; i < 2; i++ {
+		collector := &messageCollector{messages: make(chan string, 10)}
+		wsClient, _, err := gws.NewClient(collector, &gws.ClientOption{Addr: wsUrl + "/q1"})
+		if err != nil {
+			t.Fatalf("error connecting ws client: %s", err.Error())
+		}
+		go wsClient.ReadLoop()
+		select {
+		case message := <-collector.messages:
+			received = append(received, message)
+		case <-time.After(5 * time.Second):
+		}
+		wsClient.WriteClose(1000, []byte("done"))
+	}
+	// compare results
+	got := fmt.Sprintf("%v", received)
+	want := `[[2,"m1","Reset",{}] [2,"m1","Reset",{}]]`
+	if got != want {
+		t.Errorf("got %q, wanted %q", got, want)
+	}
+}
+
+// TestDurableQueueWriteFailed pushes a message when the queue store can not
+// be written and checks that the push fails with a 500.
+func TestDurableQueueWriteFailed(t *testing.T) {
+	// start ws server with a closed queue store
+	config := defaultConfig()
+	config.QueueTtl = time.Minute
+	config.QueueDir = t.TempDir()
+	handler := newHandler(config)
+	if err := handler.openQueue(); err != nil {
+		t.Fatalf("error opening queue: %s", err.Error())
+	}
+	handler.store.close()
+	wsServer := httptest.NewServer(handler)
+	defer wsServer.Close()
+	// push message
+	response, err := http.Post(wsServer.URL+"/q1", "text/plain", strings.NewReader("one"))
+	if err != nil {
+		t.Fatalf("error pushing message: %s", err.Error())
+	}
+	bodyBytes, _ := io.ReadAll(response.Body)
+	// compare results
+	got := fmt.Sprintf("%d %s", response.StatusCode, bodyBytes)
+	want := "500 could not queue message"
+	if got != want {
+		t.Errorf("got %q, wanted %q", got, want)
+	}
+}
+
+// TestAckTracking pushes two CALLs of which only one is answered and checks
+// the retransmission and the outcomes that are posted to the callback url.
+func TestAckTracking(t *testing.T) {
+	// start api server
+	outcomes := make(chan string, 10)
+	apiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/callback" {
+			bodyBytes, _ := io.ReadAll(r.Body)
+			outcomes <- string(bodyBytes)
+		}
+		if r.Method != "POST" {
+			w.Write([]byte("ok"))
+		}
+	}))
+	defer apiServer.Close()
+	// start ws server
+	config := defaultConfig()
+	config.ServerUrl = apiServer.URL + "/"
+	config.AckTimeout = 100 * time.Millisecond
+	config.AckRetries = 1
+	config.AckCallbackUrl = apiServer.URL + "/callback"
+	wsServer := httptest.NewServer(newHandler(config))
+	defer wsServer.Close()
+	wsUrl := strings.Replace(wsServer.URL, "http://", "ws://", 1)
+	// connect to ws server
+	collector := &messageCollector{messages: make(chan string, 10)}
+	wsClient, _, err := gws.NewClient(collector, &gws.ClientOption{Addr: wsUrl + "/a1"})
+	if err != nil {
+		t.Fatalf("error connecting ws client: %s", err.Error())
+	}
+	defer wsClient.WriteClose(1000, []byte("done"))
+	go wsClient.ReadLoop()
+	// push calls
+	for _, message := range []string{`[2,"m1","Reset",{}]`, `[2,"m2","Reset",{}]`} {
+		_, err := http.Post(wsServer.URL+"/a1", "text/plain", strings.NewReader(message))
+		if err != nil {
+			t.Fatalf("error pushing message: %s", err.Error())
+		}
+	}
+	// answer the first call only
+	received := []string{}
+	for len(received) < 3 {
+		message := <-collector.messages
+		if message == `[2,"m1","Reset",{}]` {
+			wsClient.WriteString(`[3,"m1",{}]`)
+		}
+		if message != "" {
+			received = append(received, message)
+		}
+	}
+	reported := []string{<-outcomes, <-outcomes}
+	// compare results
+	got := fmt.Sprintf("%v|%v", received, reported)
+	want := `[[2,"m1","Reset",{}] [2,"m2","Reset",{}] [2,"m2","Reset",{}]]|` +
+		`[{"clientId":"a1","messageId":"m1","outcome":"acknowledged","attempts":1} {"clientId":"a1","messageId":"m2","outcome":"timeout","attempts":2}]`
+	if got != want {
+		t.Errorf("got %q, wanted %q", got, want)
+	}
+}
+
+// TestCircuitBreaker lets the API server fail the connect requests and checks
+// the retry, the opened circuit breaker and the shed upgrade.
+func TestCircuitBreaker(t *testing.T) {
+	// start api server
+	var counter atomic.Int64
+	apiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		counter.Add(1)
+		w.WriteHeader(503)
+	}))
+	defer apiServer.Close()
+	// start ws server
+	config := defaultConfig()
+	config.ServerUrl = apiServer.URL + "/"
+	config.Retries = 1
+	config.RetryBackoff = time.Millisecond
+	config.BreakerThreshold = 2
+	config.BreakerCooldown = time.Minute
+	wsServer := httptest.NewServer(newHandler(config))
+	defer wsServer.Close()
+	wsUrl := strings.Replace(wsServer.URL, "http://", "ws://", 1)
+	// connect to ws server twice
+	statuses := []int{}
+	for i := 0; i < 2; i++ {
+		_, response, err := gws.NewClient(nil, &gws.ClientOption{Addr: wsUrl + "/test"})
+		if err == nil {
+			t.Fatalf("connected ws client")
+		}
+		statuses = append(statuses, response.StatusCode)
+	}
+	// read statistics
+	retried := getCounterValueFromStatisticsUrl(t, wsServer.URL, "requests_retried")
+	shed := getCounterValueFromStatisticsUrl(t, wsServer.URL, "requests_shed")
+	state := getCounterValueFromStatisticsUrl(t, wsServer.URL, `circuit_breaker_state{route="default",variant="default"}`)
+	// compare results
+	got := fmt.Sprintf("%v %d %d %d %d", statuses, counter.Load(), retried, shed, state)
+	want := "[502 503] 2 1 1 1"
+	if got != want {
+		t.Errorf("got %q, wanted %q", got, want)
+	}
+}
+
+// TestCircuitBreakerPerRoute lets the API server of one route fail and
+// checks that the circuit breaker of the other route stays closed.
+func TestCircuitBreakerPerRoute(t *testing.T) {
+	// start api servers
+	failingServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(503)
+	}))
+	defer failingServer.Close()
+	workingServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer workingServer.Close()
+	// start ws server
+	config := defaultConfig()
+	config.ServerUrl = workingServer.URL + "/"
+	config.Routes = []Route{{Name: "failing", Path: "/failing/{id}", ServerUrls: stringList{failingServer.URL + "/"}}}
+	config.BreakerThreshold = 1
+	config.BreakerCooldown = time.Minute
+	wsServer := httptest.NewServer(newHandler(config))
+	defer wsServer.Close()
+	wsUrl := strings.Replace(wsServer.URL, "http://", "ws://", 1)
+	// connect to the failing route twice and to the default route
+	statuses := []int{}
+	for i := 0; i < 2; i++ {
+		_, response, err := gws.NewClient(nil, &gws.ClientOption{Addr: wsUrl + "/failing/test"})
+		if err == nil {
+			t.Fatalf("connected ws client")
+		}
+		statuses = append(statuses, response.StatusCode)
+	}
+	wsClient, _, err := gws.NewClient(nil, &gws.ClientOption{Addr: wsUrl + "/test"})
+	if err != nil {
+		t.Fatalf("error connecting ws client: %s", err.Error())
+	}
+	defer wsClient.WriteClose(1000, []byte("done"))
+	// read statistics
+	failing := getCounterValueFromStatisticsUrl(t, wsServer.URL, `circuit_breaker_state{route="failing",variant="default"}`)
+	working := getCounterValueFromStatisticsUrl(t, wsServer.URL, `circuit_breaker_state{route="default",variant="default"}`)
+	// compare results
+	got := fmt.Sprintf("%v %d %d", statuses, failing, working)
+	want := "[502 503] 1 0"
+	if got != want {
+		t.Errorf("got %q, wanted %q", got, want)
+	}
+}
+
+// TestRetryUpstream lets the first of two API servers fail the connect and
+// checks that the retry goes to the other API server.
+func TestRetryUpstream(t *testing.T) {
+	// start api servers
+	requests := make(chan string, 10)
+	failingServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- "failing " + r.Method
+		w.WriteHeader(503)
+	}))
+	defer failingServer.Close()
+	workingServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- "working " + r.Method
+		w.Write([]byte("ok"))
+	}))
+	defer workingServer.Close()
+	// start ws server
+	config := defaultConfig()
+	config.ServerUrls = stringList{failingServer.URL + "/", workingServer.URL + "/"}
+	config.Retries = 1
+	config.RetryBackoff = time.Millisecond
+	wsServer := httptest.NewServer(newHandler(config))
+	defer wsServer.Close()
+	wsUrl := strings.Replace(wsServer.URL, "http://", "ws://", 1)
+	// connect to ws server
+	wsClient, _, err := gws.NewClient(nil, &gws.ClientOption{Addr: wsUrl + "/test"})
+	if err != nil {
+		t.Fatalf("error connecting ws client: %s", err.Error())
+	}
+	defer wsClient.WriteClose(1000, []byte("done"))
+	// compare results
+	got := fmt.Sprintf("%s|%s", <-requests, <-requests)
+	want := "failing GET|working GET"
+	if got != want {
+		t.Errorf("got %q, wanted %q", got, want)
+	}
+}
+
+// TestIncomingMessageBackendError lets the API server fail a message and
+// checks that a CALL is answered with a CALLERROR instead of an empty message.
+func TestIncomingMessageBackendError(t *testing.T) {
+	// start api server
+	apiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			w.WriteHeader(500)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer apiServer.Close()
+	// start ws server
+	config := defaultConfig()
+	config.ServerUrl = apiServer.URL + "/"
+	config.Protocol = "ocpp"
+	wsServer := httptest.NewServer(newHandler(config))
+	defer wsServer.Close()
+	wsUrl := strings.Replace(wsServer.URL, "http://", "ws://", 1)
+	// connect to ws server
+	wsClient, _, err := gws.NewClient(nil, &gws.ClientOption{Addr: wsUrl + "/test"})
+	if err != nil {
+		t.Fatalf("error connecting ws client: %s", err.Error())
+	}
+	defer wsClient.WriteClose(1000, []byte("done"))
+	// send ws messages (the result is not answered)
+	wsClient.WriteString(`[3,"122",{}]`)
+	wsClient.WriteString(`[2,"123","Heartbeat",{}]`)
+	// receive ws message
+	messageBytes := make([]byte, 1024)
+	n, err := wsClient.NetConn().Read(messageBytes)
+	if err != nil {
+		t.Fatalf("error reading message: %s", err.Error())
+	}
+	// compare results
+	got := string(messageBytes[2:n])
+	want := `[4,"123","InternalError","API server unavailable",{}]`
+	if got != want {
+		t.Errorf("got %q, wanted %q", got, want)
+	}
+}
+
+// TestRoutes routes connections by path to weighted variants, changes the
+// weights using the routes API and checks the requests and counters.
+func TestRoutes(t *testing.T) {
+	// start api servers
+	paths := make(chan string, 10)
+	stableServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths <- "stable " + r.Method + " " + r.URL.Path
+		w.Write([]byte("ok"))
+	}))
+	defer stableServer.Close()
+	canaryServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths <- "canary " + r.Method + " " + r.URL.Path
+		w.Write([]byte("ok"))
+	}))
+	defer canaryServer.Close()
+	// start ws server
+	config := defaultConfig()
+	config.Routes = []Route{{
+		Name:     "ocpp",
+		Path:     "/ocpp/{tenant}/{id}",
+		ClientId: "{tenant}.{id}",
+		Variants: []Variant{
+			{Name: "stable", Weight: 100, ServerUrls: stringList{stableServer.URL + "/{tenant}/"}},
+			{Name: "canary", Weight: 0, ServerUrls: stringList{canaryServer.URL + "/{tenant}/"}},
+		},
+	}}
+	if err := config.validate(); err != nil {
+		t.Fatalf("invalid config: %s", err.Error())
+	}
+	wsServer := httptest.NewServer(newHandler(config))
+	defer wsServer.Close()
+	wsUrl := strings.Replace(wsServer.URL, "http://", "ws://", 1)
+	request := func(method, path string) string {
+		req, _ := http.NewRequest(method, wsServer.URL+path, nil)
+		response, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("error sending request: %s", err.Error())
+		}
+		bodyBytes, _ := io.ReadAll(response.Body)
+		return fmt.Sprintf("%d %s", response.StatusCode, strings.TrimSpace(string(bodyBytes)))
+	}
+	// connect to ws server before and after changing the weights
+	wsClient, _, err := gws.NewClient(nil, &gws.ClientOption{Addr: wsUrl + "/ocpp/t1/cp1"})
+	if err != nil {
+		t.Fatalf("error connecting ws client: %s", err.Error())
+	}
+	defer wsClient.WriteClose(1000, []byte("done"))
+	first := <-paths
+	stable := request("PUT", "/routes/ocpp/stable?weight=0")
+	canary := request("PUT", "/routes/ocpp/canary?weight=100")
+	wsClient, _, err = gws.NewClient(nil, &gws.ClientOption{Addr: wsUrl + "/ocpp/t2/cp2"})
+	if err != nil {
+		t.Fatalf("error connecting ws client: %s", err.Error())
+	}
+	defer wsClient.WriteClose(1000, []byte("done"))
+	second := <-paths
+	connection := request("GET", "/connections/t2.cp2")
+	routes := request("GET", "/routes")
+	// compare results
+	got := fmt.Sprintf("%s|%s|%s|%s|%v|%s", first, stable, canary, second, strings.HasPrefix(connection, "200"), routes)
+	want := `stable GET /t1/t1.cp1|200 ok|200 ok|canary GET /t2/t2.cp2|true|200 [{"name":"ocpp","variants":[` +
+		`{"name":"stable","weight":0,"succeeded":1,"failed":0},{"name":"canary","weight":100,"succeeded":1,"failed":0}]},` +
+		`{"name":"default","variants":[{"name":"default","weight":1,"succeeded":0,"failed":0}]}]`
+	if got != want {
+		t.Errorf("got %q, wanted %q", got, want)
+	}
+}
+
+// TestShadowTraffic mirrors the requests to a shadow API server that responds
+// differently to messages and checks that only the primary responses are sent
+// to the client and that the mismatch is counted.
+func TestShadowTraffic(t *testing.T) {
+	// start api servers
+	apiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.Method == "POST" {
+			w.Write(body)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer apiServer.Close()
+	shadowed := make(chan string, 10)
+	shadowServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		shadowed <- r.Method + " " + r.URL.Path + " " + r.Header.Get("X-Shadow")
+		if r.Method == "POST" {
+			w.Write([]byte("different"))
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer shadowServer.Close()
+	// start ws server
+	config := defaultConfig()
+	config.ServerUrl = apiServer.URL + "/api/"
+	config.ShadowUrl = shadowServer.URL
+	wsServer := httptest.NewServer(newHandler(config))
+	defer wsServer.Close()
+	wsUrl := strings.Replace(wsServer.URL, "http://", "ws://", 1)
+	// connect to ws server
+	wsClient, _, err := gws.NewClient(nil, &gws.ClientOption{Addr: wsUrl + "/test"})
+	if err != nil {
+		t.Fatalf("error connecting ws client: %s", err.Error())
+	}
+	defer wsClient.WriteClose(1000, []byte("done"))
+	// send ws message and receive the response
+	wsClient.WriteString("hello")
+	messageBytes := make([]byte, 1024)
+	n, err := wsClient.NetConn().Read(messageBytes)
+	if err != nil {
+		t.Fatalf("error reading ws message: %s", err.Error())
+	}
+	// wait for the mirrored requests
+	requests := []string{<-shadowed, <-shadowed}
+	sort.Strings(requests)
+	var matches, mismatches int64
+	for i := 0; i < 100 && matches+mismatches < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+		matches = getCounterValueFromStatisticsUrl(t, wsServer.URL, "shadow_matches")
+		mismatches = getCounterValueFromStatisticsUrl(t, wsServer.URL, "shadow_mismatches")
+	}
+	// compare results
+	got := fmt.Sprintf("%s|%v|%d %d", messageBytes[2:n], requests, matches, mismatches)
+	want := "hello|[GET /api/test 1 POST /api/test 1]|1 1"
+	if got != want {
+		t.Errorf("got %q, wanted %q", got, want)
+	}
+}
+
+// TestMetrics sends and pushes a message and checks the metrics in both the
+// Prometheus text format and the OpenMetrics format.
+func TestMetrics(t *testing.T) {
+	// start api server
+	apiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.Method == "POST" {
+			w.Write(body)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer apiServer.Close()
+	// start ws server
+	wsServer := httptest.NewServer(getWsHandler(apiServer.URL + "/"))
+	defer wsServer.Close()
+	wsUrl := strings.Replace(wsServer.URL, "http://", "ws://", 1)
+	// connect to ws server
+	collector := &messageCollector{messages: make(chan string, 10)}
+	wsClient, _, err := gws.NewClient(collector, &gws.ClientOption{Addr: wsUrl + "/test"})
+	if err != nil {
+		t.Fatalf("error connecting ws client: %s", err.Error())
+	}
+	defer wsClient.WriteClose(1000, []byte("done"))
+	go wsClient.ReadLoop()
+	// send a ws message and push a message
+	wsClient.WriteString("hello")
+	<-collector.messages
+	http.Post(wsServer.URL+"/test", "text/plain", strings.NewReader("pushed"))
+	<-collector.messages
+	// read metrics
+	metrics := func(accept string) string {
+		req, _ := http.NewRequest("GET", wsServer.URL+"/metrics", nil)
+		req.Header.Set("Accept", accept)
+		response, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("error getting metrics: %s", err.Error())
+		}
+		bodyBytes, _ := io.ReadAll(response.Body)
+		return string(bodyBytes)
+	}
+	text := metrics("text/plain")
+	openMetrics := metrics("application/openmetrics-text; version=1.0.0")
+	lines := []string{}
+	for _, line := range strings.Split(text, "\n") {
+		for _, prefix := range []string{"wsproxy_connections_active", "wsproxy_messages", "# TYPE wsproxy_messages",
+			"wsproxy_backend_responses", "wsproxy_backend_request_duration_seconds_count", "wsproxy_push_requests", "wsproxy_push_messages"} {
+			if strings.HasPrefix(line, prefix+" ") || strings.HasPrefix(line, prefix+"_total") || strings.HasPrefix(line, prefix+"{") {
+				lines = append(lines, line)
+			}
+		}
+	}
+	// compare results
+	got := fmt.Sprintf("%s|%v %v", strings.Join(lines, "|"),
+		strings.Contains(openMetrics, "# TYPE wsproxy_messages counter\n"), strings.HasSuffix(openMetrics, "# EOF\n"))
+	want := `wsproxy_connections_active 1|# TYPE wsproxy_messages_total counter|` +
+		`wsproxy_messages_total{direction="in",opcode="text"} 1|wsproxy_messages_total{direction="in",opcode="binary"} 0|` +
+		`wsproxy_messages_total{direction="out",opcode="text"} 2|wsproxy_messages_total{direction="out",opcode="binary"} 0|` +
+		`wsproxy_backend_responses_total{method="GET",code="200"} 1|wsproxy_backend_responses_total{method="POST",code="200"} 1|` +
+		`wsproxy_backend_request_duration_seconds_count{method="GET"} 1|wsproxy_backend_request_duration_seconds_count{method="POST"} 1|` +
+		`wsproxy_backend_request_duration_seconds_count{method="DELETE"} 0|` +
+		`wsproxy_push_requests_total{endpoint="push"} 1|wsproxy_push_messages_total{result="delivered"} 1|true true`
+	if got != want {
+		t.Errorf("got %q, wanted %q", got, want)
+	}
+}
+
+// TestAdminListener serves the public and the admin handler on separate
+// listeners and checks that the API is only served on the admin listener.
+func TestAdminListener(t *testing.T) {
+	// start api server
+	apiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer apiServer.Close()
+	// start ws server with an admin listener on a unix socket
+	socket := t.TempDir() + "/admin.sock"
+	config := defaultConfig()
+	config.ServerUrl = apiServer.URL + "/"
+	config.AdminListen = "unix:" + socket
+	handler := newHandler(config)
+	wsServer := httptest.NewServer(publicHandler{handler})
+	defer wsServer.Close()
+	wsUrl := strings.Replace(wsServer.URL, "http://", "ws://", 1)
+	listener, err := listenAdmin(config.AdminListen)
+	if err != nil {
+		t.Fatalf("error listening on admin socket: %s", err.Error())
+	}
+	adminServer := &http.Server{Handler: newAdminHandler(handler)}
+	go adminServer.Serve(listener)
+	defer adminServer.Close()
+	adminClient := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return net.Dial("unix", socket)
+		},
+	}}
+	request := func(client *http.Client, method, url string) string {
+		req, _ := http.NewRequest(method, url, strings.NewReader("pushed"))
+		response, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("error sending request: %s", err.Error())
+		}
+		bodyBytes, _ := io.ReadAll(response.Body)
+		return fmt.Sprintf("%d %s", response.StatusCode, strings.SplitN(string(bodyBytes), "\n", 2)[0])
+	}
+	// connect to ws server
+	collector := &messageCollector{messages: make(chan string, 10)}
+	wsClient, _, err := gws.NewClient(collector, &gws.ClientOption{Addr: wsUrl + "/test"})
+	if err != nil {
+		t.Fatalf("error connecting ws client: %s", err.Error())
+	}
+	defer wsClient.WriteClose(1000, []byte("done"))
+	go wsClient.ReadLoop()
+	// use the api on both listeners
+	results := []string{
+		request(http.DefaultClient, "GET", wsServer.URL+"/"),
+		request(http.DefaultClient, "POST", wsServer.URL+"/test"),
+		request(http.DefaultClient, "GET", wsServer.URL+"/connections"),
+		request(adminClient, "POST", "http://admin/test"),
+		request(adminClient, "GET", "http://admin/"),
+		request(adminClient, "GET", "http://admin/test"),
+		request(adminClient, "GET", "http://admin/debug/pprof/cmdline")[:3],
+	}
+	received := <-collector.messages
+	// compare results
+	got := fmt.Sprintf("%v|%s", results, received)
+	want := "[404 not found 404 not found 404 not found 200 ok 200 connections_opened 1 404 not found 200]|pushed"
+	if got != want {
+		t.Errorf("got %q, wanted %q", got, want)
+	}
+}
+
+// TestApiAuth uses the API with bearer tokens and signed requests and checks
+// the scopes, the replay protection of the nonces, the body limit and the counted failures.
+func TestApiAuth(t *testing.T) {
+	// start api server
+	apiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer apiServer.Close()
+	// start ws server
+	config := defaultConfig()
+	config.ServerUrl = apiServer.URL + "/"
+	config.Credentials = []Credential{
+		{Name: "backend", Token: "secret-token", Scopes: stringList{"push"}},
+		{Name: "monitor", HmacSecret: "secret-key", Scopes: stringList{"read-stats"}},
+	}
+	config.AuthMaxBodySize = len("pushed")
+	if err := config.validate(); err != nil {
+		t.Fatalf("invalid config: %s", err.Error())
+	}
+	wsServer := httptest.NewServer(newHandler(config))
+	defer wsServer.Close()
+	wsUrl := strings.Replace(wsServer.URL, "http://", "ws://", 1)
+	// connect to ws server
+	collector := &messageCollector{messages: make(chan string, 10)}
+	wsClient, _, err := gws.NewClient(collector, &gws.ClientOption{Addr: wsUrl + "/test"})
+	if err != nil {
+		t.Fatalf("error connecting ws client: %s", err.Error())
+	}
+	defer wsClient.WriteClose(1000, []byte("done"))
+	go wsClient.ReadLoop()
+	request := func(method, path, authorization string, signedAt time.Time, nonce, body string) string {
+		req, _ := http.NewRequest(method, wsServer.URL+path, strings.NewReader(body))
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		if !signedAt.IsZero() {
+			timestamp := strconv.FormatInt(signedAt.Unix(), 10)
+			req.Header.Set("X-Timestamp", timestamp)
+			req.Header.Set("X-Nonce", nonce)
+			req.Header.Set("X-Signature", "monitor="+apiSignature([]byte("secret-key"), method, path, timestamp, nonce, []byte(body)))
+		}
+		response, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("error sending request: %s", err.Error())
+		}
+		bodyBytes, _ := io.ReadAll(response.Body)
+		return fmt.Sprintf("%d %s", response.StatusCode, strings.SplitN(string(bodyBytes), "\n", 2)[0])
+	}
+	// use the api with and without credentials
+	now := time.Now()
+	results := []string{
+		request("POST", "/test", "", time.Time{}, "", "pushed"),
+		request("POST", "/test", "Bearer wrong-token", time.Time{}, "", "pushed"),
+		request("GET", "/", "Bearer secret-token", time.Time{}, "", "pushed"),
+		request("POST", "/test", "Bearer secret-token", time.Time{}, "", "pushed"),
+		request("GET", "/connections?limit=1", "", now, "n1", "pushed"),
+		request("GET", "/connections?limit=1", "", now, "n2", "pushed"),
+		request("GET", "/connections?limit=1", "", now, "n2", "pushed"),
+		request("GET", "/connections?limit=1", "", now.Add(-time.Hour), "n3", "pushed"),
+		request("GET", "/connections?limit=2", "", now, "n4", "too large"),
+	}
+	received := <-collector.messages
+	// read the failures from the metrics
+	req, _ := http.NewRequest("GET", wsServer.URL+"/metrics", nil)
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	req.Header.Set("X-Timestamp", timestamp)
+	req.Header.Set("X-Nonce", "n5")
+	req.Header.Set("X-Signature", "monitor="+apiSignature([]byte("secret-key"), "GET", "/metrics", timestamp, "n5", nil))
+	response, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("error getting metrics: %s", err.Error())
+	}
+	bodyBytes, _ := io.ReadAll(response.Body)
+	failures := []string{}
+	for _, line := range strings.Split(string(bodyBytes), "\n") {
+		if strings.HasPrefix(line, "wsproxy_auth_failures_total") {
+			failures = append(failures, line)
+		}
+	}
+	// compare results
+	got := fmt.Sprintf("%v|%s|%s|%s", results[:4], received, strings.Join([]string{results[4][:3], results[5][:3], results[6], results[7], results[8]}, " "), strings.Join(failures, " "))
+	want := "[401 unauthorized 401 unauthorized 403 forbidden 200 ok]|pushed|200 200 401 unauthorized 401 unauthorized 401 unauthorized|" +
+		`wsproxy_auth_failures_total{reason="expired"} 1 wsproxy_auth_failures_total{reason="forbidden"} 1 ` +
+		`wsproxy_auth_failures_total{reason="invalid"} 2 wsproxy_auth_failures_total{reason="missing"} 1 ` +
+		`wsproxy_auth_failures_total{reason="replayed"} 1`
+	if got != want {
+		t.Errorf("got %q, wanted %q", got, want)
+	}
+}
+
+// TestSignedRequests lets the API server verify the signatures of the
+// requests of the proxy with both signing keys.
+func TestSignedRequests(t *testing.T) {
+	// start api server
+	verified := make(chan string, 10)
+	apiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		timestamp := r.Header.Get("X-Timestamp")
+		results := []string{}
+		for _, signature := range strings.Split(r.Header.Get("X-Signature"), ",") {
+			id, value, _ := strings.Cut(signature, "=")
+			secret := map[string]string{"v1": "old-secret", "v2": "new-secret"}[id]
+			valid := value == requestSignature([]byte(secret), r.Method, r.URL.RequestURI(), timestamp, body)
+			results = append(results, fmt.Sprintf("%s=%v", id, valid))
+		}
+		verified <- r.Method + " " + strings.Join(results, ",")
+		w.Write([]byte("ok"))
+	}))
+	defer apiServer.Close()
+	// start ws server
+	config := defaultConfig()
+	config.ServerUrl = apiServer.URL + "/"
+	config.SigningKeys = stringList{"v1:old-secret", "v2:new-secret"}
+	if err := config.validate(); err != nil {
+		t.Fatalf("invalid config: %s", err.Error())
+	}
+	wsServer := httptest.NewServer(newHandler(config))
+	defer wsServer.Close()
+	wsUrl := strings.Replace(wsServer.URL, "http://", "ws://", 1)
+	// connect to ws server and send a message
+	wsClient, _, err := gws.NewClient(nil, &gws.ClientOption{Addr: wsUrl + "/test"})
+	if err != nil {
+		t.Fatalf("error connecting ws client: %s", err.Error())
+	}
+	defer wsClient.WriteClose(1000, []byte("done"))
+	wsClient.WriteString("hello")
+	// compare results
+	got := fmt.Sprintf("%s|%s|%v", <-verified, <-verified, strings.Contains(config.String(), "- v2:redacted\n"))
+	want := "GET v1=true,v2=true|POST v1=true,v2=true|true"
+	if got != want {
+		t.Errorf("got %q, wanted %q", got, want)
+	}
+}
+
+// TestRoutesTemplate expands a ClientId template with a path variable that
+// contains a placeholder and checks that it is not expanded again.
+func TestRoutesTemplate(t *testing.T) {
+	vars := map[string]string{"tenant": "{id}", "id": "CP1"}
+	results := map[string]bool{}
+	for i := 0; i < 20; i++ {
+		results[expandTemplate("{tenant}.{id}.{other}", vars)] = true
+	}
+	// compare results
+	got := fmt.Sprintf("%v", results)
+	want := "map[{id}.CP1.{other}:true]"
+	if got != want {
+		t.Errorf("got %q, wanted %q", got, want)
+	}
+}
+
+// TestRoutesEscaping connects with path variables that contain reserved
+// characters and checks that they are escaped in the path of the API server
+// url and that they are rejected in the host of the API server url.
+func TestRoutesEscaping(t *testing.T) {
+	// start api server
+	paths := make(chan string, 10)
+	apiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths <- r.Method + " " + r.RequestURI
+		w.Write([]byte("ok"))
+	}))
+	defer apiServer.Close()
+	// start ws server
+	config := defaultConfig()
+	config.Routes = []Route{{
+		Name:     "ocpp",
+		Path:     "/ocpp/{tenant}/{id}",
+		ClientId: "{id}",
+		Variants: []Variant{{Name: "default", Weight: 1, ServerUrls: stringList{apiServer.URL + "/{tenant}/"}}},
+	}, {
+		Name:     "tenant",
+		Path:     "/tenant/{tenant}/{id}",
+		ClientId: "{id}",
+		Variants: []Variant{{Name: "default", Weight: 1, ServerUrls: stringList{"http://{tenant}.localhost/"}}},
+	}}
+	if err := config.validate(); err != nil {
+		t.Fatalf("invalid config: %s", err.Error())
+	}
+	wsServer := httptest.NewServer(newHandler(config))
+	defer wsServer.Close()
+	wsUrl := strings.Replace(wsServer.URL, "http://", "ws://", 1)
+	// connect to ws server
+	wsClient, _, err := gws.NewClient(nil, &gws.ClientOption{Addr: wsUrl + "/ocpp/acme%3Fadmin=1%23/CP1"})
+	if err != nil {
+		t.Fatalf("error connecting ws client: %s", err.Error())
+	}
+	defer wsClient.WriteClose(1000, []byte("done"))
+	connect := <-paths
+	_, response, err := gws.NewClient(nil, &gws.ClientOption{Addr: wsUrl + "/tenant/evil.com%3A80%40/CP2"})
+	status := 0
+	if response != nil {
+		status = response.StatusCode
+	}
+	// compare results
+	got := fmt.Sprintf("%s|%d|%v", connect, status, err != nil)
+	want := "GET /acme%3Fadmin=1%23/CP1|400|true"
+	if got != want {
+		t.Errorf("got %q, wanted %q", got, want)
+	}
+}